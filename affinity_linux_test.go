@@ -0,0 +1,21 @@
+package profile
+
+import "testing"
+
+func TestCPURanges(t *testing.T) {
+	tests := []struct {
+		cpus []int
+		want string
+	}{
+		{nil, ""},
+		{[]int{0}, "0"},
+		{[]int{0, 1, 2, 3}, "0-3"},
+		{[]int{0, 1, 2, 3, 8}, "0-3,8"},
+		{[]int{1, 3, 4, 6, 7, 8}, "1,3-4,6-8"},
+	}
+	for _, tt := range tests {
+		if got := cpuRanges(tt.cpus); got != tt.want {
+			t.Errorf("cpuRanges(%v): wanted %q, got %q", tt.cpus, tt.want, got)
+		}
+	}
+}
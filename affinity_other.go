@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package profile
+
+// cpuAffinity is not supported on this platform, the returned
+// ok value is always false.
+func cpuAffinity() (string, bool, error) { return "", false, nil }
@@ -0,0 +1,20 @@
+//go:build go1.18
+// +build go1.18
+
+package profile
+
+import "runtime/debug"
+
+// cgoEnabled reports whether the program was built with cgo enabled.
+func cgoEnabled() bool {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return true
+	}
+	for _, s := range bi.Settings {
+		if s.Key == "CGO_ENABLED" {
+			return s.Value == "1"
+		}
+	}
+	return true
+}
@@ -0,0 +1,8 @@
+//go:build !go1.18
+// +build !go1.18
+
+package profile
+
+// cgoEnabled reports whether the program was built with cgo enabled.
+// Build settings are not recorded before Go 1.18, so assume it was.
+func cgoEnabled() bool { return true }
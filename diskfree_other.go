@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package profile
+
+// freeSpace is not supported on this platform, the returned
+// ok value is always false.
+func freeSpace(dir string) (uint64, bool, error) { return 0, false, nil }
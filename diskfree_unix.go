@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package profile
+
+import "golang.org/x/sys/unix"
+
+// freeSpace returns the number of bytes available to unprivileged
+// users on the filesystem containing dir.
+func freeSpace(dir string) (uint64, bool, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, false, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), true, nil
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package profile_test
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/pkg/profile"
+)
+
+func ExampleProfileOnSignal() {
+	// capture a 30 second cpu profile each time the process
+	// receives SIGUSR2.
+	defer profile.Start(profile.ProfileOnSignal(syscall.SIGUSR2, profile.CPUProfile, 30*time.Second)).Stop()
+}
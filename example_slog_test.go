@@ -0,0 +1,17 @@
+//go:build go1.21
+// +build go1.21
+
+package profile_test
+
+import (
+	"log/slog"
+	"os"
+
+	"github.com/pkg/profile"
+)
+
+func ExampleSlog() {
+	// log the start and stop of profiling as json records.
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	defer profile.Start(profile.Slog(logger)).Stop()
+}
@@ -1,9 +1,24 @@
 package profile_test
 
 import (
+	"bytes"
+	"compress/zlib"
+	"context"
 	"flag"
+	"io"
+	"log"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	pprofile "github.com/google/pprof/profile"
 	"github.com/pkg/profile"
 )
 
@@ -13,22 +28,67 @@ func ExampleStart() {
 	defer profile.Start().Stop()
 }
 
+func ExampleStartErr() {
+	// carry on without profiling if the session cannot be started.
+	p, err := profile.StartErr(profile.ProfilePath("/var/lib/myservice/profiles"))
+	if err != nil {
+		log.Printf("profiling disabled: %v", err)
+		return
+	}
+	defer p.Stop()
+}
+
+func ExampleRun() {
+	realMain := func() {
+		// the program, which returns rather than calling os.Exit.
+	}
+
+	// profile realMain, writing the profile when it returns.
+	profile.Run(realMain, profile.CPUProfile)
+}
+
 func ExampleCPUProfile() {
 	// CPU profiling is the default profiling mode, but you can specify it
 	// explicitly for completeness.
 	defer profile.Start(profile.CPUProfile).Stop()
 }
 
+func ExampleCgoHint() {
+	// warn if cgo calls may leave the cpu profile with incomplete stacks.
+	defer profile.Start(profile.CPUProfile, profile.CgoHint).Stop()
+}
+
 func ExampleMemProfile() {
 	// use memory profiling, rather than the default cpu profiling.
 	defer profile.Start(profile.MemProfile).Stop()
 }
 
+func ExampleDefaultMemProfileRate() {
+	// record every allocation in all memory profiles of the program,
+	// set before any session is started.
+	profile.DefaultMemProfileRate = 1
+
+	defer profile.Start(profile.MemProfile).Stop()
+}
+
+func ExampleSetDefaultMemProfileRate() {
+	// record every allocation in memory profiles started from now on,
+	// even while other goroutines are starting sessions.
+	profile.SetDefaultMemProfileRate(1)
+
+	defer profile.Start(profile.MemProfile).Stop()
+}
+
 func ExampleMemProfileRate() {
 	// use memory profiling with custom rate.
 	defer profile.Start(profile.MemProfileRate(2048)).Stop()
 }
 
+func ExampleHeapDelta() {
+	// write mem-delta.pprof, showing only what the heap grew by.
+	defer profile.Start(profile.HeapDelta).Stop()
+}
+
 func ExampleMemProfileHeap() {
 	// use heap memory profiling.
 	defer profile.Start(profile.MemProfileHeap).Stop()
@@ -39,16 +99,642 @@ func ExampleMemProfileAllocs() {
 	defer profile.Start(profile.MemProfileAllocs).Stop()
 }
 
+func ExampleThreadcreationProfile() {
+	// write the stacks which created os threads to threadcreation.pprof.
+	defer profile.Start(profile.ThreadcreationProfile).Stop()
+}
+
+func ExampleThreadcreateProfile() {
+	// write threadcreation.pprof, as ThreadcreationProfile does.
+	defer profile.Start(profile.ThreadcreateProfile).Stop()
+}
+
+func ExampleGoroutineProfile() {
+	// write the stacks of all goroutines to goroutine.pprof on Stop.
+	defer profile.Start(profile.GoroutineProfile).Stop()
+}
+
+func ExampleTransform() {
+	// remove the build machine's directory layout from the
+	// file names in the heap profile.
+	trim := func(data []byte) ([]byte, error) {
+		prof, err := pprofile.ParseData(data)
+		if err != nil {
+			return nil, err
+		}
+		for _, fn := range prof.Function {
+			fn.Filename = strings.TrimPrefix(fn.Filename, "/home/builder/")
+		}
+		var buf bytes.Buffer
+		err = prof.Write(&buf)
+		return buf.Bytes(), err
+	}
+	defer profile.Start(profile.MemProfile, profile.Transform(trim)).Stop()
+}
+
+func ExampleMutexProfile() {
+	// write the holders of contended mutexes to mutex.pprof on Stop.
+	defer profile.Start(profile.MutexProfile).Stop()
+}
+
+func ExampleMutexProfileFraction() {
+	// profile mutex contention and blocking together, each at its own rate.
+	defer profile.Start(profile.MutexProfileFraction(10), profile.Also(profile.BlockProfileRate(10000))).Stop()
+}
+
+func ExampleGCPercent() {
+	// collect garbage more often while investigating the heap,
+	// restoring the previous setting on Stop.
+	defer profile.Start(profile.MemProfile, profile.GCPercent(20)).Stop()
+}
+
+func ExampleGCBeforeSnapshot() {
+	// collect garbage before writing the heap profile.
+	defer profile.Start(profile.MemProfile, profile.GCBeforeSnapshot).Stop()
+}
+
+func ExamplePMUProfile() {
+	// sample last level cache misses, on Linux.
+	defer profile.Start(profile.PMUProfile("cache-misses")).Stop()
+}
+
 func ExampleProfilePath() {
 	// set the location that the profile will be written to
 	defer profile.Start(profile.ProfilePath(os.Getenv("HOME"))).Stop()
 }
 
+func ExampleCompressOver() {
+	// compress profiles larger than 1MiB when profiling stops.
+	defer profile.Start(profile.TraceProfile, profile.CompressOver(1<<20)).Stop()
+}
+
+func ExampleCompress() {
+	// write the execution trace to trace.out.gz.
+	defer profile.Start(profile.TraceProfile, profile.Compress).Stop()
+}
+
+func ExampleCompressor() {
+	// write the execution trace through zlib to trace.out.zz. A zstd
+	// encoder, such as that of github.com/klauspost/compress/zstd,
+	// may be used in the same way to write trace.out.zst.
+	zz := func(w io.Writer) (io.WriteCloser, error) { return zlib.NewWriter(w), nil }
+	defer profile.Start(profile.TraceProfile, profile.Compressor(".zz", zz)).Stop()
+}
+
+func ExampleUpload() {
+	// upload the profile to a collector when profiling stops.
+	defer profile.Start(profile.Upload("http://localhost:4040/ingest")).Stop()
+}
+
+func ExampleFilterLabels() {
+	// only keep the goroutines labelled with tenant=acme.
+	defer profile.Start(profile.GoroutineProfile, profile.FilterLabels("tenant", "^acme$")).Stop()
+}
+
+func ExampleProfile_Results() {
+	// record the profiling window for correlation with other monitoring.
+	p := profile.Start()
+	// ...
+	p.Stop()
+	r := p.Results()
+	log.Printf("profiled from %v to %v", r.Start, r.End)
+}
+
+func ExampleProfile_CaptureAndStop() {
+	// capture the goroutine and heap profiles if main panics.
+	p := profile.Start(profile.MemProfile)
+	defer func() {
+		if r := recover(); r != nil {
+			p.CaptureAndStop()
+			panic(r)
+		}
+		p.Stop()
+	}()
+}
+
+func ExampleDeterministic() {
+	// write the goroutine profile in a stable order for golden file tests.
+	defer profile.Start(profile.GoroutineProfile, profile.Deterministic).Stop()
+}
+
+func ExampleProfile_Flush() {
+	// write a snapshot of the heap without stopping profiling.
+	p := profile.Start(profile.MemProfile)
+	defer p.Stop()
+	// ...
+	p.Flush()
+}
+
+func ExampleMaxBytes() {
+	// stop tracing once 512MiB of trace data have been written.
+	defer profile.Start(profile.TraceProfile, profile.MaxBytes(512<<20)).Stop()
+}
+
+func ExamplePreallocate() {
+	// reserve 1GiB of disk space up front for a large trace.
+	defer profile.Start(profile.TraceProfile, profile.Preallocate(1<<30)).Stop()
+}
+
+func ExampleMergeOnStop() {
+	// rotate the cpu profile periodically, so a crash loses at most
+	// a minute of data, and merge the pieces when profiling stops.
+	p := profile.Start(profile.CPUProfile, profile.MergeOnStop)
+	defer p.Stop()
+	go func() {
+		for range time.Tick(time.Minute) {
+			p.Flush()
+		}
+	}()
+}
+
+func ExampleResetOnFlush() {
+	// write the mutex contention of each minute to its own file.
+	p := profile.Start(profile.MutexProfile, profile.ResetOnFlush)
+	defer p.Stop()
+	go func() {
+		for range time.Tick(time.Minute) {
+			p.Flush()
+		}
+	}()
+}
+
+func ExampleRingBuffer() {
+	// keep the last ten goroutine snapshots, taken every minute,
+	// and write them out on Stop.
+	p := profile.Start(profile.GoroutineProfile, profile.RingBuffer(10))
+	defer p.Stop()
+	go func() {
+		for range time.Tick(time.Minute) {
+			p.Flush()
+		}
+	}()
+}
+
+func ExampleContinuous() {
+	// write heap and goroutine profiles every ten minutes for the
+	// life of the program, keeping the last day's worth.
+	defer profile.Start(profile.Continuous(10*time.Minute, 144)).Stop()
+}
+
+func ExampleAutoName() {
+	// name the profile after the program, e.g. myservice-cpu.pprof.
+	defer profile.Start(profile.AutoName).Stop()
+}
+
+func ExampleSync() {
+	// make sure the profile is on disk before the program crashes.
+	defer profile.Start(profile.MemProfile, profile.Sync).Stop()
+}
+
+func ExampleMinFreeSpace() {
+	// refuse to start profiling with less than 1GiB of free disk space.
+	defer profile.Start(profile.TraceProfile, profile.MinFreeSpace(1<<30)).Stop()
+}
+
+func ExampleTempRoot() {
+	// create the temporary profile directory on a local disk.
+	defer profile.Start(profile.TempRoot("/var/tmp")).Stop()
+}
+
+func ExampleJSONLog() {
+	// log the start and stop of profiling as JSON objects.
+	defer profile.Start(profile.JSONLog(os.Stderr)).Stop()
+}
+
+func ExampleCPUProfileRate() {
+	// use a cpu profiling rate of 500 Hz.
+	defer profile.Start(profile.CPUProfileRate(500)).Stop()
+}
+
+func ExampleComment() {
+	// note why the profile was captured.
+	defer profile.Start(profile.Comment("captured during incident-1234")).Stop()
+}
+
+func ExampleWriteInvocation() {
+	// record the command line, and the Go runtime settings from
+	// the environment, alongside the profile.
+	defer profile.Start(profile.WriteInvocation("GO*")).Stop()
+}
+
+func ExampleWebUI() {
+	// open the cpu profile in the pprof web ui on Stop.
+	defer profile.Start(profile.WebUI).Stop()
+}
+
+func ExampleTextReport() {
+	// write report.txt, a summary of the cpu profile, on Stop.
+	defer profile.Start(profile.TextReport).Stop()
+}
+
+func ExampleMemBothViews() {
+	// write mem-inuse_space.txt and mem-alloc_space.txt alongside
+	// the memory profile on Stop.
+	defer profile.Start(profile.MemProfile, profile.MemBothViews).Stop()
+}
+
+func ExampleProfile_StopAndWait() {
+	// stop profiling from a watchdog and ship the profile once
+	// it is safely on disk.
+	p := profile.Start(profile.MemProfile, profile.ProfilePath("."))
+	go func() {
+		time.Sleep(time.Minute)
+		if err := p.StopAndWait(); err != nil {
+			log.Fatal(err)
+		}
+		// upload mem.pprof
+	}()
+}
+
+func ExampleTarWriter() {
+	// upload the cpu and memory profiles as a single tar stream,
+	// without writing them to disk.
+	r, w := io.Pipe()
+	go func() {
+		resp, err := http.Post("http://collector:4000/profiles", "application/x-tar", r)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		resp.Body.Close()
+	}()
+	defer w.Close()
+	defer profile.Start(profile.CPUProfile, profile.Also(profile.MemProfile), profile.TarWriter(w)).Stop()
+}
+
+func ExampleReason() {
+	// record why the profile was taken in its name, cpu.scheduled.pprof.
+	defer profile.Start(profile.Reason("scheduled")).Stop()
+}
+
+func ExampleRotation() {
+	// rotate cpu profiles of 64MB, keeping the latest and 4 older
+	// files for at most a week.
+	defer profile.Start(profile.Rotation(64, 4, 7)).Stop()
+}
+
+func ExampleFlamegraph() {
+	// write flame.svg, a flame graph of the cpu profile.
+	defer profile.Start(profile.Flamegraph).Stop()
+}
+
+func ExampleDirPolicy() {
+	// keep the profiles of earlier runs, writing cpu.1.pprof
+	// if cpu.pprof exists.
+	defer profile.Start(profile.DirPolicy(profile.Number), profile.ProfilePath(".")).Stop()
+}
+
+func ExampleRecordDuration() {
+	// report contentions per second of the session.
+	defer profile.Start(profile.BlockProfile, profile.RecordDuration).Stop()
+}
+
+func ExampleLazy() {
+	// configure a session now and start it later.
+	p := profile.Start(profile.Lazy, profile.MemProfile)
+	defer p.Stop()
+
+	// when profiling is needed.
+	p.Begin()
+}
+
+func ExampleProfile_BeginErr() {
+	// start a lazy session from library code, carrying on without
+	// profiling if it cannot be started.
+	p := profile.Start(profile.Lazy, profile.MemProfile)
+	defer p.Stop()
+
+	if err := p.BeginErr(); err != nil {
+		log.Printf("profiling unavailable: %v", err)
+	}
+}
+
+func ExampleMaxSessions() {
+	// profile on demand at most ten times.
+	profile.MaxSessions(10)
+	defer profile.Start().Stop()
+}
+
+func ExampleFoldedStacks() {
+	// write cpu.folded for flamegraph.pl alongside cpu.pprof.
+	defer profile.Start(profile.FoldedStacks).Stop()
+}
+
+func ExampleCorrelationID() {
+	// write job-42-cpu.pprof, grouped with the job's other profiles.
+	defer profile.Start(profile.CorrelationID("job-42")).Stop()
+}
+
+func ExampleDisableUnderPressure() {
+	// do not profile, or stop profiling, once the heap reaches 1GB.
+	defer profile.Start(profile.MemProfile, profile.DisableUnderPressure(1<<30)).Stop()
+}
+
+func ExampleLogger() {
+	// log profiling messages through the program's own logger.
+	logger := log.New(os.Stderr, "myservice: ", log.LstdFlags)
+	defer profile.Start(profile.Logger(logger)).Stop()
+}
+
+func ExampleWriteTo() {
+	// write the memory profile to a buffer rather than to disk.
+	var buf bytes.Buffer
+	defer profile.Start(profile.MemProfile, profile.WriteTo(profile.MemProfile, &buf)).Stop()
+}
+
+func ExampleFilenameTemplate() {
+	// name the cpu profile e.g. cpu-20060102T150405Z-1234.pprof so
+	// successive runs do not overwrite it.
+	defer profile.Start(profile.FilenameTemplate("{{.Name}}-{{.Time}}-{{.PID}}{{.Ext}}")).Stop()
+}
+
+func ExampleHostPID() {
+	// name the cpu profile e.g. cpu-myhost-1234.pprof so workers
+	// sharing an output directory do not overwrite each other's.
+	defer profile.Start(profile.HostPID, profile.ProfilePath("/mnt/profiles")).Stop()
+}
+
+func ExampleProfileName() {
+	// write the cpu profile to api-cpu.pprof.
+	defer profile.Start(profile.ProfileName(profile.CPUProfile, "api-cpu.pprof")).Stop()
+}
+
+func ExamplePermissions() {
+	// keep the profiles private to the user running the program.
+	defer profile.Start(profile.Permissions(0700, 0600), profile.ProfilePath("/var/tmp/profiles")).Stop()
+}
+
+func ExampleAtomicWrites() {
+	// profiles appear in the directory only once complete.
+	defer profile.Start(profile.AtomicWrites, profile.ProfilePath("/var/spool/profiles")).Stop()
+}
+
+func ExampleProfile_StopErr() {
+	p := profile.Start(profile.MemProfile)
+	// ...
+	files, err := p.StopErr()
+	if err != nil {
+		log.Fatalf("profiles not written: %v", err)
+	}
+	log.Printf("profiles written to %v", files)
+}
+
+func ExampleProfile_Files() {
+	p := profile.Start(profile.MemProfile)
+	log.Printf("writing profiles to %s", p.Path())
+	p.Stop()
+	for _, fn := range p.Files() {
+		log.Printf("wrote %s", fn)
+	}
+}
+
+func ExampleOnStop() {
+	// upload the profiles once they have been written.
+	defer profile.Start(profile.OnStop(func(files []string) {
+		for _, fn := range files {
+			log.Printf("uploading %s", fn)
+		}
+	})).Stop()
+}
+
+func ExampleAfterStop() {
+	// log when each session began and how long it profiled for.
+	defer profile.Start(
+		profile.BeforeStart(func(start time.Time) {
+			log.Printf("profiling session started at %v", start)
+		}),
+		profile.AfterStop(func(r profile.Results) {
+			log.Printf("profiled for %v", r.End.Sub(r.Start))
+		}),
+	).Stop()
+}
+
+func ExampleStartWithContext() {
+	// the program cancels ctx to shut down.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer profile.StartWithContext(ctx).Stop()
+}
+
+func ExampleDuration() {
+	// profile the next 30 seconds, then write cpu.pprof.
+	profile.Start(profile.Duration(30 * time.Second))
+}
+
+func ExampleDelay() {
+	// skip the first 10 seconds of warm up, then profile for 30.
+	defer profile.Start(profile.Delay(10*time.Second), profile.Duration(30*time.Second)).Stop()
+}
+
+func ExampleContinuousCPU() {
+	// write the cpu profile in 30 second windows, keeping the last
+	// ten, as well as heap and goroutine snapshots.
+	defer profile.Start(profile.Continuous(30*time.Second, 10), profile.ContinuousCPU).Stop()
+}
+
+func ExampleMaxFiles() {
+	// keep at most 100 profiles, none older than a week, in the
+	// directory written to by every run of the service.
+	defer profile.Start(profile.Continuous(time.Minute, 0), profile.ProfilePath("/var/lib/profiles"),
+		profile.MaxFiles(100), profile.MaxAge(7*24*time.Hour)).Stop()
+}
+
+func ExampleOmitEmpty() {
+	// only keep the block profile if goroutines blocked, the runtime
+	// may record contention on its own locks in a mutex profile.
+	defer profile.Start(profile.BlockProfile, profile.OmitEmpty).Stop()
+}
+
+func ExampleVerify() {
+	// check the memory profile can be parsed before it is archived.
+	defer profile.Start(profile.MemProfile, profile.Verify).Stop()
+}
+
+func ExampleOnStart() {
+	// report where the profiles of the session will be written.
+	defer profile.Start(profile.OnStart(func(path string) {
+		log.Printf("profiling to %s", path)
+	})).Stop()
+}
+
+func ExampleStartAfter() {
+	// begin profiling once the first 1000 requests have warmed up
+	// the service.
+	var requests int64
+	defer profile.Start(profile.StartAfter(&requests, 1000)).Stop()
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		// handle the request
+	})
+}
+
+func ExampleIndexHTML() {
+	// write index.html, listing how to open each profile, to share
+	// the output directory with others.
+	defer profile.Start(profile.CPUProfile, profile.Also(profile.MemProfile), profile.IndexHTML).Stop()
+}
+
+func ExampleOverheadStats() {
+	// measure how long it took to start and stop block profiling.
+	p := profile.Start(profile.BlockProfile, profile.OverheadStats)
+	p.Stop()
+
+	o := p.Results().Overhead
+	log.Printf("start took %v, stop took %v", o.Start, o.Stop)
+}
+
+func ExampleSignalAction() {
+	// write a snapshot of the memory profile each time the program
+	// receives SIGINT, rather than exiting.
+	defer profile.Start(profile.MemProfile, profile.SignalAction(profile.FlushAndContinue)).Stop()
+}
+
+func ExampleMeta() {
+	// stamp the profiles with where and why they were taken.
+	defer profile.Start(profile.Meta(map[string]string{
+		"datacenter": "ams1",
+		"experiment": "E42",
+	})).Stop()
+}
+
+func ExampleAffinityNote() {
+	// record the cpus the program is pinned to in the profile comments.
+	defer profile.Start(profile.AffinityNote).Stop()
+}
+
+func ExampleLatestSymlink() {
+	// link cpu-latest.pprof to the newest cpu profile, so that
+	// go tool pprof $HOME/profiles/cpu-latest.pprof opens it.
+	defer profile.Start(profile.LatestSymlink, profile.AutoName, profile.ProfilePath(os.Getenv("HOME")+"/profiles")).Stop()
+}
+
+func ExampleCustomProfile() {
+	// write the stacks which opened the files still open on Stop,
+	// recorded by the program in a profile of its own.
+	openFiles := pprof.NewProfile("example.com/openfiles")
+	f, err := os.Open("config.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	openFiles.Add(f, 1)
+
+	defer profile.Start(profile.CustomProfile("example.com/openfiles")).Stop()
+}
+
+func ExampleTee() {
+	// stream the cpu profile to a collector as well as to cpu.pprof.
+	conn, err := net.Dial("tcp", "collector:4000")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer profile.Start(profile.Tee(conn)).Stop()
+}
+
+func ExampleFile() {
+	// write the cpu profile to an already open file.
+	f, err := os.OpenFile("cpu.pprof", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	defer profile.Start(profile.File(f)).Stop()
+}
+
+func ExampleIsolated() {
+	// profile each request to the /slow endpoint into a directory
+	// named after its request ID.
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		defer profile.Start(
+			profile.Isolated,
+			profile.Labels("request", id),
+			profile.FilterLabels("request", "^"+regexp.QuoteMeta(id)+"$"),
+			profile.ProfilePath(filepath.Join("profiles", id)),
+		).Stop()
+
+		// handle the request
+	}
+	http.HandleFunc("/slow", slow)
+}
+
+func ExampleMinGoroutines() {
+	// profile once 100 goroutines are running, or after a minute.
+	defer profile.Start(profile.MinGoroutines(100, time.Minute)).Stop()
+}
+
+func ExampleLabelsFromContext() {
+	// label cpu samples with the ID of the current span, found by
+	// a function provided by the tracing library in use.
+	var spanID func(ctx context.Context) (string, bool)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		extract := func(ctx context.Context, key string) (string, bool) {
+			return spanID(ctx)
+		}
+		defer profile.Start(
+			profile.Isolated,
+			profile.LabelsFromContext(r.Context(), "span_id"),
+			profile.LabelExtractor(extract),
+		).Stop()
+
+		// handle the request
+	}
+	http.HandleFunc("/", handler)
+}
+
+func ExampleValidate() {
+	// fail at startup if the profiling configuration is unusable.
+	options := []func(*profile.Profile){
+		profile.CPUProfileRate(500),
+		profile.ProfilePath("/var/lib/app/profiles"),
+	}
+	if err := profile.Validate(options...); err != nil {
+		log.Fatalf("invalid profiling configuration: %v", err)
+	}
+
+	defer profile.Start(options...).Stop()
+}
+
+func ExampleWhen() {
+	// only profile the heap if it has grown beyond 1GiB.
+	defer profile.Start(profile.MemProfile, profile.When(func() bool {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		return m.HeapAlloc > 1<<30
+	})).Stop()
+}
+
+func ExampleFS() {
+	// write profiles to an in memory, or remote, file system.
+	var fsys profile.FileSystem
+	defer profile.Start(profile.FS(fsys)).Stop()
+}
+
+func ExampleDirAttempts() {
+	// try up to five times to create the output directory.
+	defer profile.Start(profile.DirAttempts(5)).Stop()
+}
+
+func ExampleStrictStop() {
+	// panic if the profile is stopped twice.
+	defer profile.Start(profile.StrictStop).Stop()
+}
+
+func ExampleVerbosity() {
+	// log warnings, but not the start and stop of profiling.
+	defer profile.Start(profile.Verbosity(profile.LevelWarn)).Stop()
+}
+
 func ExampleNoShutdownHook() {
 	// disable the automatic shutdown hook.
 	defer profile.Start(profile.NoShutdownHook).Stop()
 }
 
+func ExampleShutdownHook() {
+	// install the shutdown hook even when running under go test.
+	defer profile.Start(profile.ShutdownHook).Stop()
+}
+
 func ExampleStart_withFlags() {
 	// use the flags package to selectively enable profiling.
 	mode := flag.String("profile.mode", "", "enable profiling mode, one of [cpu, mem, mutex, block]")
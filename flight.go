@@ -0,0 +1,34 @@
+//go:build go1.25
+// +build go1.25
+
+package profile
+
+import (
+	"io"
+	"runtime/trace"
+	"time"
+)
+
+// flightRecorder keeps the most recent window of the execution trace
+// in memory.
+type flightRecorder struct {
+	fr *trace.FlightRecorder
+}
+
+// startFlight starts a flight recorder keeping at least window of
+// the execution trace.
+func startFlight(window time.Duration) (*flightRecorder, error) {
+	fr := trace.NewFlightRecorder(trace.FlightRecorderConfig{MinAge: window})
+	if err := fr.Start(); err != nil {
+		return nil, err
+	}
+	return &flightRecorder{fr: fr}, nil
+}
+
+// writeTo writes the window kept to w as an execution trace.
+func (f *flightRecorder) writeTo(w io.Writer) error {
+	_, err := f.fr.WriteTo(w)
+	return err
+}
+
+func (f *flightRecorder) stop() { f.fr.Stop() }
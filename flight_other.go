@@ -0,0 +1,21 @@
+//go:build !go1.25
+// +build !go1.25
+
+package profile
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// flightRecorder is not supported before Go 1.25.
+type flightRecorder struct{}
+
+func startFlight(window time.Duration) (*flightRecorder, error) {
+	return nil, errors.New("flight recording requires Go 1.25 or later")
+}
+
+func (*flightRecorder) writeTo(w io.Writer) error { return nil }
+
+func (*flightRecorder) stop() {}
@@ -0,0 +1,227 @@
+package profile
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileSystem is the file system profiles are written to.
+type FileSystem interface {
+	// Create creates or truncates the named file for writing.
+	Create(name string) (io.WriteCloser, error)
+
+	// Open opens the named file for reading.
+	Open(name string) (io.ReadCloser, error)
+
+	// Remove removes the named file.
+	Remove(name string) error
+
+	// MkdirAll creates the directory path, and any parents
+	// which do not exist, with the permissions perm.
+	MkdirAll(path string, perm os.FileMode) error
+
+	// MkdirTemp creates a new temporary directory in dir whose
+	// name begins with pattern, and returns its path. If dir is
+	// blank the default directory for temporary files is used.
+	MkdirTemp(dir, pattern string) (string, error)
+}
+
+// osFS is the FileSystem of the operating system. Files are created
+// with the permissions perm, if not zero, exactly. If atomic is set
+// files are written to a hidden temporary file beside them, which is
+// renamed into place when closed.
+type osFS struct {
+	perm   os.FileMode
+	atomic bool
+}
+
+func (fs osFS) Create(name string) (io.WriteCloser, error) {
+	fn := name
+	if fs.atomic {
+		fn = filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+	}
+	perm := fs.perm
+	if perm == 0 {
+		perm = 0666
+	}
+	f, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+	if fs.perm != 0 {
+		if err := f.Chmod(fs.perm); err != nil {
+			f.Close()
+			os.Remove(fn)
+			return nil, err
+		}
+	}
+	if fs.atomic {
+		return &atomicFile{File: f, name: name}, nil
+	}
+	return f, nil
+}
+
+func (osFS) Open(name string) (io.ReadCloser, error) { return os.Open(name) }
+
+func (osFS) Remove(name string) error { return os.Remove(name) }
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+
+func (osFS) MkdirTemp(dir, pattern string) (string, error) { return ioutil.TempDir(dir, pattern) }
+
+// atomicFile is a temporary file which is renamed to name when closed.
+type atomicFile struct {
+	*os.File
+	name string
+}
+
+func (f *atomicFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+	return os.Rename(f.File.Name(), f.name)
+}
+
+// osFile returns the operating system file f writes to, if any.
+func osFile(f io.WriteCloser) (*os.File, bool) {
+	switch f := f.(type) {
+	case *os.File:
+		return f, true
+	case *atomicFile:
+		return f.File, true
+	}
+	return nil, false
+}
+
+// bufferFS is a FileSystem held in memory, used by TarWriter.
+// Files are listed in the order they were first created.
+type bufferFS struct {
+	mu    sync.Mutex
+	files map[string]*bytes.Buffer
+	names []string
+}
+
+func newBufferFS() *bufferFS {
+	return &bufferFS{files: make(map[string]*bytes.Buffer)}
+}
+
+func (fs *bufferFS) Create(name string) (io.WriteCloser, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	buf, ok := fs.files[name]
+	if !ok {
+		buf = new(bytes.Buffer)
+		fs.files[name] = buf
+		fs.names = append(fs.names, name)
+	}
+	buf.Reset()
+	return &bufferFile{fs: fs, buf: buf}, nil
+}
+
+func (fs *bufferFS) Open(name string) (io.ReadCloser, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	buf, ok := fs.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	data := append([]byte(nil), buf.Bytes()...)
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (fs *bufferFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(fs.files, name)
+	for i, n := range fs.names {
+		if n == name {
+			fs.names = append(fs.names[:i], fs.names[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (fs *bufferFS) MkdirAll(path string, perm os.FileMode) error { return nil }
+
+func (fs *bufferFS) MkdirTemp(dir, pattern string) (string, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, pattern), nil
+}
+
+// each calls fn with the name and contents of each file.
+func (fs *bufferFS) each(fn func(name string, data []byte) error) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, name := range fs.names {
+		if err := fn(name, fs.files[name].Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bufferFile is a file of a bufferFS open for writing.
+type bufferFile struct {
+	fs  *bufferFS
+	buf *bytes.Buffer
+}
+
+func (f *bufferFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return f.buf.Write(p)
+}
+
+func (f *bufferFile) Close() error { return nil }
+
+// fileSize returns the size of the named file in fsys, from its
+// metadata if fsys is the operating system's, without reading it.
+func fileSize(fsys FileSystem, name string) (int64, error) {
+	if _, ok := fsys.(osFS); ok {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return 0, err
+		}
+		return fi.Size(), nil
+	}
+	f, err := fsys.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(ioutil.Discard, f)
+}
+
+// readFile returns the contents of the named file in fsys.
+func readFile(fsys FileSystem, name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// writeFile writes data to the named file in fsys.
+func writeFile(fsys FileSystem, name string, data []byte) error {
+	f, err := fsys.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, bytes.NewReader(data)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -2,4 +2,8 @@ module github.com/pkg/profile
 
 go 1.13
 
-require github.com/felixge/fgprof v0.9.3
+require (
+	github.com/felixge/fgprof v0.9.3
+	github.com/google/pprof v0.0.0-20211214055906-6f57359322fd
+	golang.org/x/sys v0.0.0-20211007075335-d3039528d8ac
+)
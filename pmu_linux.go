@@ -0,0 +1,329 @@
+package profile
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	pprofile "github.com/google/pprof/profile"
+	"golang.org/x/sys/unix"
+)
+
+// pmuEvents maps the names accepted by PMUProfile to perf events
+// and the number of events between samples.
+var pmuEvents = map[string]struct {
+	typ            uint32
+	config, period uint64
+	unit           string
+}{
+	"cycles":           {unix.PERF_TYPE_HARDWARE, unix.PERF_COUNT_HW_CPU_CYCLES, 1000000, "count"},
+	"instructions":     {unix.PERF_TYPE_HARDWARE, unix.PERF_COUNT_HW_INSTRUCTIONS, 1000000, "count"},
+	"cache-references": {unix.PERF_TYPE_HARDWARE, unix.PERF_COUNT_HW_CACHE_REFERENCES, 10000, "count"},
+	"cache-misses":     {unix.PERF_TYPE_HARDWARE, unix.PERF_COUNT_HW_CACHE_MISSES, 10000, "count"},
+	"branches":         {unix.PERF_TYPE_HARDWARE, unix.PERF_COUNT_HW_BRANCH_INSTRUCTIONS, 100000, "count"},
+	"branch-misses":    {unix.PERF_TYPE_HARDWARE, unix.PERF_COUNT_HW_BRANCH_MISSES, 10000, "count"},
+	"cpu-clock":        {unix.PERF_TYPE_SOFTWARE, unix.PERF_COUNT_SW_CPU_CLOCK, 1000000, "nanoseconds"},
+}
+
+const (
+	// pmuPages is the number of data pages in each ring buffer.
+	pmuPages = 16
+
+	// pmuPoll is the interval at which the ring buffers are read.
+	pmuPoll = 10 * time.Millisecond
+
+	// perfRecordSample is PERF_RECORD_SAMPLE.
+	perfRecordSample = 9
+
+	// perfContextMax is PERF_CONTEXT_MAX, (u64)-4095. Callchain
+	// entries at or above it mark a change of context rather than
+	// an address.
+	perfContextMax = ^uint64(4094)
+)
+
+// pmuProfiler samples a hardware event in every thread of the process
+// using perf_event_open.
+type pmuProfiler struct {
+	event  string
+	unit   string
+	period uint64
+	attr   unix.PerfEventAttr
+	tids   map[int]bool
+	fds    []int
+	rings  [][]byte
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	samples map[string]*pmuSample
+}
+
+// pmuSample counts the samples taken with a given stack.
+type pmuSample struct {
+	stack []uint64
+	count int64
+}
+
+// startPMU starts sampling the named hardware event.
+func startPMU(event string) (*pmuProfiler, error) {
+	ev, ok := pmuEvents[event]
+	if !ok {
+		return nil, fmt.Errorf("unknown pmu event %q", event)
+	}
+	pp := &pmuProfiler{
+		event:  event,
+		unit:   ev.unit,
+		period: ev.period,
+		attr: unix.PerfEventAttr{
+			Type:        ev.typ,
+			Config:      ev.config,
+			Sample:      ev.period,
+			Sample_type: unix.PERF_SAMPLE_IP | unix.PERF_SAMPLE_CALLCHAIN,
+			Bits:        unix.PerfBitDisabled | unix.PerfBitExcludeKernel | unix.PerfBitExcludeHv,
+		},
+		tids:    make(map[int]bool),
+		done:    make(chan struct{}),
+		samples: make(map[string]*pmuSample),
+	}
+	pp.attr.Size = uint32(unsafe.Sizeof(pp.attr))
+	if err := pp.attach(); err != nil {
+		pp.close()
+		return nil, err
+	}
+	pp.wg.Add(1)
+	go pp.poll()
+	return pp, nil
+}
+
+// attach opens an event for each thread of the process not yet sampled.
+// The kernel does not allow the ring buffer of an event inherited by
+// new threads to be mapped, so threads are found by polling.
+func (pp *pmuProfiler) attach() error {
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	size := (1 + pmuPages) * os.Getpagesize()
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil || pp.tids[tid] {
+			continue
+		}
+		fd, err := unix.PerfEventOpen(&pp.attr, tid, -1, -1, unix.PERF_FLAG_FD_CLOEXEC)
+		if err == unix.ESRCH {
+			// the thread has exited.
+			continue
+		}
+		if err != nil {
+			return pmuError(err)
+		}
+		ring, err := unix.Mmap(fd, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+		if err != nil {
+			unix.Close(fd)
+			return fmt.Errorf("mmap: %v", err)
+		}
+		if err := unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_ENABLE, 0); err != nil {
+			unix.Munmap(ring)
+			unix.Close(fd)
+			return fmt.Errorf("perf_event_ioc_enable: %v", err)
+		}
+		pp.mu.Lock()
+		pp.tids[tid] = true
+		pp.fds = append(pp.fds, fd)
+		pp.rings = append(pp.rings, ring)
+		pp.mu.Unlock()
+	}
+	return nil
+}
+
+// pmuError explains the common reasons perf_event_open fails.
+func pmuError(err error) error {
+	switch err {
+	case unix.EACCES, unix.EPERM:
+		return fmt.Errorf("perf_event_open: %v, see /proc/sys/kernel/perf_event_paranoid", err)
+	case unix.ENOENT, unix.EOPNOTSUPP:
+		return fmt.Errorf("perf_event_open: %v, hardware events are not supported on this machine", err)
+	}
+	return fmt.Errorf("perf_event_open: %v", err)
+}
+
+// poll reads the ring buffers until stop is called.
+func (pp *pmuProfiler) poll() {
+	defer pp.wg.Done()
+	t := time.NewTicker(pmuPoll)
+	defer t.Stop()
+	for {
+		select {
+		case <-pp.done:
+			return
+		case <-t.C:
+			pp.attach()
+			pp.read()
+		}
+	}
+}
+
+// read records the samples waiting in the ring buffers.
+func (pp *pmuProfiler) read() {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	for _, ring := range pp.rings {
+		meta := (*unix.PerfEventMmapPage)(unsafe.Pointer(&ring[0]))
+		data := ring[os.Getpagesize():]
+		head := atomic.LoadUint64(&meta.Data_head)
+		tail := meta.Data_tail
+		for tail < head {
+			hdr := wrapped(data, tail, 8)
+			typ := binary.LittleEndian.Uint32(hdr)
+			size := uint64(binary.LittleEndian.Uint16(hdr[6:]))
+			if size < 8 {
+				break
+			}
+			if typ == perfRecordSample {
+				pp.record(wrapped(data, tail, size)[8:])
+			}
+			tail += size
+		}
+		atomic.StoreUint64(&meta.Data_tail, tail)
+	}
+}
+
+// wrapped returns n bytes of the ring buffer data starting at off.
+func wrapped(data []byte, off, n uint64) []byte {
+	size := uint64(len(data))
+	start := off % size
+	if start+n <= size {
+		return data[start : start+n]
+	}
+	buf := make([]byte, 0, n)
+	buf = append(buf, data[start:]...)
+	return append(buf, data[:n-(size-start)]...)
+}
+
+// record records a PERF_RECORD_SAMPLE holding an ip and callchain.
+func (pp *pmuProfiler) record(rec []byte) {
+	if len(rec) < 16 {
+		return
+	}
+	ip := binary.LittleEndian.Uint64(rec)
+	nr := binary.LittleEndian.Uint64(rec[8:])
+	var stack []uint64
+	for i := uint64(0); i < nr && int(16+8*i+8) <= len(rec); i++ {
+		pc := binary.LittleEndian.Uint64(rec[16+8*i:])
+		if pc >= perfContextMax {
+			continue
+		}
+		stack = append(stack, pc)
+	}
+	if len(stack) == 0 {
+		stack = append(stack, ip)
+	}
+	key := fmt.Sprint(stack)
+	s, ok := pp.samples[key]
+	if !ok {
+		s = &pmuSample{stack: stack}
+		pp.samples[key] = s
+	}
+	s.count++
+}
+
+// close releases the events and their ring buffers.
+func (pp *pmuProfiler) close() {
+	for _, ring := range pp.rings {
+		unix.Munmap(ring)
+	}
+	for _, fd := range pp.fds {
+		unix.Close(fd)
+	}
+	pp.rings, pp.fds = nil, nil
+}
+
+// stop stops sampling and writes the samples taken to w as a
+// pprof formatted profile.
+func (pp *pmuProfiler) stop(w io.Writer) error {
+	close(pp.done)
+	pp.wg.Wait()
+	for _, fd := range pp.fds {
+		unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_DISABLE, 0)
+	}
+	pp.read()
+	pp.close()
+	return pp.profile().Write(w)
+}
+
+// profile returns the samples taken as a pprof profile, symbolized
+// using the symbol table of the running program.
+func (pp *pmuProfiler) profile() *pprofile.Profile {
+	prof := &pprofile.Profile{
+		SampleType: []*pprofile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: pp.event, Unit: pp.unit},
+		},
+		PeriodType:        &pprofile.ValueType{Type: pp.event, Unit: pp.unit},
+		Period:            int64(pp.period),
+		TimeNanos:         time.Now().UnixNano(),
+		DefaultSampleType: pp.event,
+	}
+	locs := make(map[uint64]*pprofile.Location)
+	funcs := make(map[string]*pprofile.Function)
+	location := func(pc uint64, leaf bool) *pprofile.Location {
+		if l, ok := locs[pc]; ok {
+			return l
+		}
+		l := &pprofile.Location{ID: uint64(len(prof.Location) + 1), Address: pc}
+		// CallersFrames expects return addresses, which
+		// follow the call, but the leaf pc is exact.
+		lookup := uintptr(pc)
+		if leaf {
+			lookup++
+		}
+		frames := runtime.CallersFrames([]uintptr{lookup})
+		for {
+			frame, more := frames.Next()
+			if frame.Function != "" {
+				fn, ok := funcs[frame.Function]
+				if !ok {
+					fn = &pprofile.Function{
+						ID:         uint64(len(prof.Function) + 1),
+						Name:       frame.Function,
+						SystemName: frame.Function,
+						Filename:   frame.File,
+					}
+					funcs[frame.Function] = fn
+					prof.Function = append(prof.Function, fn)
+				}
+				l.Line = append(l.Line, pprofile.Line{Function: fn, Line: int64(frame.Line)})
+			}
+			if !more {
+				break
+			}
+		}
+		locs[pc] = l
+		prof.Location = append(prof.Location, l)
+		return l
+	}
+	for _, s := range pp.samples {
+		sample := &pprofile.Sample{Value: []int64{s.count, s.count * int64(pp.period)}}
+		for i, pc := range s.stack {
+			sample.Location = append(sample.Location, location(pc, i == 0))
+		}
+		prof.Sample = append(prof.Sample, sample)
+	}
+	return prof
+}
+
+// checkPMU returns an error if event is not known to PMUProfile.
+func checkPMU(event string) error {
+	if _, ok := pmuEvents[event]; !ok {
+		return fmt.Errorf("unknown pmu event %q", event)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package profile
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestWrapped(t *testing.T) {
+	data := []byte{0, 1, 2, 3, 4, 5, 6, 7}
+	if got := wrapped(data, 10, 4); string(got) != string(data[2:6]) {
+		t.Errorf("wrapped: wanted %v, got %v", data[2:6], got)
+	}
+	if got, want := wrapped(data, 14, 4), []byte{6, 7, 0, 1}; string(got) != string(want) {
+		t.Errorf("wrapped: wanted %v, got %v", want, got)
+	}
+}
+
+func TestPMURecord(t *testing.T) {
+	pp := &pmuProfiler{samples: make(map[string]*pmuSample)}
+	// ip, nr, then a callchain holding a context marker.
+	rec := make([]byte, 8*5)
+	for i, v := range []uint64{0x10, 3, perfContextMax + 1, 0x10, 0x20} {
+		binary.LittleEndian.PutUint64(rec[8*i:], v)
+	}
+	pp.record(rec)
+	pp.record(rec)
+	if len(pp.samples) != 1 {
+		t.Fatalf("record: wanted 1 stack, got %d", len(pp.samples))
+	}
+	for _, s := range pp.samples {
+		if len(s.stack) != 2 || s.stack[0] != 0x10 || s.stack[1] != 0x20 || s.count != 2 {
+			t.Errorf("record: wanted stack [0x10 0x20] counted twice, got %x counted %d times", s.stack, s.count)
+		}
+	}
+}
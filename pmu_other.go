@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package profile
+
+import (
+	"errors"
+	"io"
+)
+
+// pmuProfiler is not supported on this platform.
+type pmuProfiler struct{}
+
+func startPMU(event string) (*pmuProfiler, error) {
+	return nil, errors.New("pmu profiling is only supported on linux")
+}
+
+func (*pmuProfiler) stop(w io.Writer) error { return nil }
+
+// checkPMU accepts any event, Start logs that pmu profiling is not
+// supported and continues without it.
+func checkPMU(event string) error { return nil }
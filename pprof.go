@@ -0,0 +1,546 @@
+package profile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	pprofile "github.com/google/pprof/profile"
+)
+
+// rewrite parses the pprof formatted profile stored in fn in fsys,
+// applies edit to it, and writes the result back to fn.
+func rewrite(fsys FileSystem, fn string, edit func(*pprofile.Profile) (*pprofile.Profile, error)) error {
+	data, err := readFile(fsys, fn)
+	if err != nil {
+		return err
+	}
+	prof, err := pprofile.ParseData(data)
+	if err != nil {
+		return err
+	}
+	prof, err = edit(prof)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := prof.Write(&buf); err != nil {
+		return err
+	}
+	return writeFile(fsys, fn, buf.Bytes())
+}
+
+// mergeFiles merges the pprof formatted profiles stored in fns in fsys
+// into fns[0] and removes the rest.
+func mergeFiles(fsys FileSystem, fns []string) error {
+	profs := make([]*pprofile.Profile, 0, len(fns))
+	for _, fn := range fns {
+		data, err := readFile(fsys, fn)
+		if err != nil {
+			return err
+		}
+		prof, err := pprofile.ParseData(data)
+		if err != nil {
+			return fmt.Errorf("%s: %v", fn, err)
+		}
+		profs = append(profs, prof)
+	}
+	merged, err := pprofile.Merge(profs)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := merged.Write(&buf); err != nil {
+		return err
+	}
+	if err := writeFile(fsys, fns[0], buf.Bytes()); err != nil {
+		return err
+	}
+	for _, fn := range fns[1:] {
+		if err := fsys.Remove(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delta returns a profile holding the difference between cur and
+// an earlier profile base of the same kind.
+func delta(cur, base *pprofile.Profile) (*pprofile.Profile, error) {
+	neg := base.Copy()
+	neg.Scale(-1)
+	d, err := pprofile.Merge([]*pprofile.Profile{cur, neg})
+	if err != nil {
+		return nil, err
+	}
+	d.TimeNanos = cur.TimeNanos
+	d.DurationNanos = cur.TimeNanos - base.TimeNanos
+	return d, nil
+}
+
+// labelFilter matches samples carrying a label whose value matches re.
+type labelFilter struct {
+	key  string
+	expr string
+	re   *regexp.Regexp
+}
+
+// match reports whether s carries a label matching f.
+func (f *labelFilter) match(s *pprofile.Sample) bool {
+	for _, v := range s.Label[f.key] {
+		if f.re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterLabels returns prof restricted to the samples which match
+// every label filter.
+func filterLabels(prof *pprofile.Profile, filters []*labelFilter) *pprofile.Profile {
+	samples := prof.Sample[:0]
+	for _, s := range prof.Sample {
+		keep := true
+		for _, f := range filters {
+			keep = keep && f.match(s)
+		}
+		if keep {
+			samples = append(samples, s)
+		}
+	}
+	prof.Sample = samples
+	return prof.Compact()
+}
+
+// hasLabels reports whether any sample of prof carries a label.
+func hasLabels(prof *pprofile.Profile) bool {
+	for _, s := range prof.Sample {
+		if len(s.Label) > 0 || len(s.NumLabel) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// sortProfile orders the samples, locations, functions and mappings of
+// prof, and renumbers their IDs, so that equivalent profiles serialize
+// identically. Timestamps, which differ between runs, are cleared.
+func sortProfile(prof *pprofile.Profile) *pprofile.Profile {
+	prof.TimeNanos = 0
+	prof.DurationNanos = 0
+
+	sort.SliceStable(prof.Mapping, func(i, j int) bool {
+		a, b := prof.Mapping[i], prof.Mapping[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Start < b.Start
+	})
+	for i, m := range prof.Mapping {
+		m.ID = uint64(i + 1)
+	}
+
+	sort.SliceStable(prof.Function, func(i, j int) bool {
+		a, b := prof.Function[i], prof.Function[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.SystemName != b.SystemName {
+			return a.SystemName < b.SystemName
+		}
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		return a.StartLine < b.StartLine
+	})
+	for i, f := range prof.Function {
+		f.ID = uint64(i + 1)
+	}
+
+	locKeys := make(map[*pprofile.Location]string, len(prof.Location))
+	for _, l := range prof.Location {
+		locKeys[l] = locationKey(l)
+	}
+	sort.SliceStable(prof.Location, func(i, j int) bool {
+		a, b := prof.Location[i], prof.Location[j]
+		if ka, kb := locKeys[a], locKeys[b]; ka != kb {
+			return ka < kb
+		}
+		return a.Address < b.Address
+	})
+	for i, l := range prof.Location {
+		l.ID = uint64(i + 1)
+	}
+
+	sampleKeys := make(map[*pprofile.Sample]string, len(prof.Sample))
+	for _, s := range prof.Sample {
+		sampleKeys[s] = sampleKey(s)
+	}
+	sort.SliceStable(prof.Sample, func(i, j int) bool {
+		return sampleKeys[prof.Sample[i]] < sampleKeys[prof.Sample[j]]
+	})
+	return prof
+}
+
+// locationKey returns a string identifying l by its mapping and
+// symbolic information rather than its ID.
+func locationKey(l *pprofile.Location) string {
+	var b strings.Builder
+	if l.Mapping != nil {
+		fmt.Fprintf(&b, "%d;", l.Mapping.ID)
+	}
+	for _, ln := range l.Line {
+		if ln.Function != nil {
+			fmt.Fprintf(&b, "%d:", ln.Function.ID)
+		}
+		fmt.Fprintf(&b, "%d;", ln.Line)
+	}
+	return b.String()
+}
+
+// sampleKey returns a string identifying s by its stack, labels and values.
+// Location IDs are zero padded so the key sorts numerically.
+func sampleKey(s *pprofile.Sample) string {
+	var b strings.Builder
+	for _, l := range s.Location {
+		fmt.Fprintf(&b, "%016x;", l.ID)
+	}
+	keys := make([]string, 0, len(s.Label))
+	for k := range s.Label {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%v;", k, s.Label[k])
+	}
+	for _, v := range s.Value {
+		fmt.Fprintf(&b, "%020d;", v)
+	}
+	return b.String()
+}
+
+// errNoSymbols is returned by textReport for profiles which carry
+// no function names.
+var errNoSymbols = errors.New("profile has no symbol information")
+
+// reportEntry holds the flat and cumulative values of a function.
+type reportEntry struct {
+	name      string
+	flat, cum int64
+}
+
+// textReport writes a summary of prof, stored in fn, to w listing the
+// top n functions by flat and by cumulative value of its default
+// sample type.
+func textReport(w io.Writer, fn string, prof *pprofile.Profile, n int) error {
+	idx, err := reportIndex(prof)
+	if err != nil {
+		return err
+	}
+	st := prof.SampleType[idx]
+
+	entries := make(map[string]*reportEntry)
+	entry := func(name string) *reportEntry {
+		e, ok := entries[name]
+		if !ok {
+			e = &reportEntry{name: name}
+			entries[name] = e
+		}
+		return e
+	}
+	var total int64
+	for _, s := range prof.Sample {
+		if len(s.Location) == 0 {
+			continue
+		}
+		v := s.Value[idx]
+		total += v
+		seen := make(map[string]bool)
+		for i, l := range s.Location {
+			for j, name := range locationNames(l) {
+				if i == 0 && j == 0 {
+					entry(name).flat += v
+				}
+				if !seen[name] {
+					seen[name] = true
+					entry(name).cum += v
+				}
+			}
+		}
+	}
+
+	list := make([]*reportEntry, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, e)
+	}
+
+	fmt.Fprintf(w, "File: %s\n", fn)
+	fmt.Fprintf(w, "Type: %s\n", st.Type)
+	fmt.Fprintf(w, "Total: %s\n", formatValue(total, st.Unit))
+	for _, by := range []string{"flat", "cum"} {
+		sort.SliceStable(list, func(i, j int) bool {
+			a, b := list[i], list[j]
+			if by == "cum" && a.cum != b.cum {
+				return a.cum > b.cum
+			}
+			if a.flat != b.flat {
+				return a.flat > b.flat
+			}
+			if a.cum != b.cum {
+				return a.cum > b.cum
+			}
+			return a.name < b.name
+		})
+		fmt.Fprintf(w, "\nTop %d functions by %s:\n", n, by)
+		fmt.Fprintf(w, "%10s %7s %7s %10s %7s\n", "flat", "flat%", "sum%", "cum", "cum%")
+		var sum int64
+		for i, e := range list {
+			if i == n {
+				break
+			}
+			sum += e.flat
+			fmt.Fprintf(w, "%10s %7s %7s %10s %7s  %s\n",
+				formatValue(e.flat, st.Unit), percent(e.flat, total), percent(sum, total),
+				formatValue(e.cum, st.Unit), percent(e.cum, total), e.name)
+		}
+	}
+	return nil
+}
+
+// reportIndex returns the index of the default sample type of prof,
+// or an error if prof cannot be reported on.
+func reportIndex(prof *pprofile.Profile) (int, error) {
+	if len(prof.SampleType) == 0 {
+		return 0, errors.New("profile has no sample types")
+	}
+	idx := len(prof.SampleType) - 1
+	for i, st := range prof.SampleType {
+		if st.Type == prof.DefaultSampleType {
+			idx = i
+		}
+	}
+	for _, l := range prof.Location {
+		for _, ln := range l.Line {
+			if ln.Function != nil && ln.Function.Name != "" {
+				return idx, nil
+			}
+		}
+	}
+	return 0, errNoSymbols
+}
+
+const (
+	// flameWidth is the width of a flame graph in pixels.
+	flameWidth = 1200
+
+	// flameFrame is the height of each frame of a flame graph.
+	flameFrame = 16
+
+	// flameMinWidth is the width below which frames are not drawn.
+	flameMinWidth = 0.1
+)
+
+// flameNode is a function in the call tree drawn by flamegraph.
+type flameNode struct {
+	name     string
+	value    int64
+	children map[string]*flameNode
+}
+
+func (n *flameNode) child(name string) *flameNode {
+	c, ok := n.children[name]
+	if !ok {
+		c = &flameNode{name: name, children: make(map[string]*flameNode)}
+		n.children[name] = c
+	}
+	return c
+}
+
+// flamegraph writes an svg flame graph of the default sample type of
+// prof to w. Callers are drawn below their callees, and the callees
+// of each function are sorted by name.
+func flamegraph(w io.Writer, prof *pprofile.Profile) error {
+	idx, err := reportIndex(prof)
+	if err != nil {
+		return err
+	}
+	st := prof.SampleType[idx]
+	root := &flameNode{name: "all", children: make(map[string]*flameNode)}
+	depth := 0
+	for _, s := range prof.Sample {
+		v := s.Value[idx]
+		if v <= 0 {
+			continue
+		}
+		root.value += v
+		n, d := root, 0
+		for i := len(s.Location) - 1; i >= 0; i-- {
+			names := locationNames(s.Location[i])
+			for j := len(names) - 1; j >= 0; j-- {
+				n = n.child(names[j])
+				n.value += v
+				d++
+			}
+		}
+		if d > depth {
+			depth = d
+		}
+	}
+	if root.value == 0 {
+		return errors.New("profile has no samples")
+	}
+
+	height := (depth + 1) * flameFrame
+	ew := &errWriter{w: w}
+	fmt.Fprintf(ew, `<?xml version="1.0" standalone="no"?>`+"\n")
+	fmt.Fprintf(ew, `<svg version="1.1" width="%d" height="%d" viewBox="0 0 %d %d" xmlns="http://www.w3.org/2000/svg">`+"\n",
+		flameWidth, height, flameWidth, height)
+	fmt.Fprintf(ew, `<style>text { font-family: monospace; font-size: 11px; pointer-events: none; }</style>`+"\n")
+	scale := float64(flameWidth) / float64(root.value)
+	var draw func(n *flameNode, x float64, d int)
+	draw = func(n *flameNode, x float64, d int) {
+		width := float64(n.value) * scale
+		if width < flameMinWidth {
+			return
+		}
+		y := height - (d+1)*flameFrame
+		title := fmt.Sprintf("%s (%s, %s)", n.name, formatValue(n.value, st.Unit), percent(n.value, root.value))
+		fmt.Fprintf(ew, `<g><title>%s</title><rect x="%.2f" y="%d" width="%.2f" height="%d" fill="%s" rx="2"/>`,
+			html.EscapeString(title), x, y, width, flameFrame-1, flameColor(n.name))
+		// at 11px a monospace character is about 7px wide.
+		if chars := int(width-6) / 7; chars >= 3 {
+			label := n.name
+			if len(label) > chars {
+				label = label[:chars-2] + ".."
+			}
+			fmt.Fprintf(ew, `<text x="%.2f" y="%d">%s</text>`, x+3, y+flameFrame-4, html.EscapeString(label))
+		}
+		fmt.Fprintf(ew, "</g>\n")
+		names := make([]string, 0, len(n.children))
+		for name := range n.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			c := n.children[name]
+			draw(c, x, d+1)
+			x += float64(c.value) * scale
+		}
+	}
+	draw(root, 0, 0)
+	fmt.Fprintf(ew, "</svg>\n")
+	return ew.err
+}
+
+// foldedEscaper replaces the semicolons and spaces which separate the
+// fields of a folded stack.
+var foldedEscaper = strings.NewReplacer(";", ":", " ", "_")
+
+// foldedStacks writes the samples of the default sample type of prof
+// to w in the folded format read by flame graph tools, one line per
+// stack listing its functions outermost first, separated by semicolons,
+// followed by the total value of its samples. Lines are sorted.
+func foldedStacks(w io.Writer, prof *pprofile.Profile) error {
+	idx, err := reportIndex(prof)
+	if err != nil {
+		return err
+	}
+	totals := make(map[string]int64)
+	for _, s := range prof.Sample {
+		v := s.Value[idx]
+		if v == 0 || len(s.Location) == 0 {
+			continue
+		}
+		var frames []string
+		for i := len(s.Location) - 1; i >= 0; i-- {
+			names := locationNames(s.Location[i])
+			for j := len(names) - 1; j >= 0; j-- {
+				frames = append(frames, foldedEscaper.Replace(names[j]))
+			}
+		}
+		totals[strings.Join(frames, ";")] += v
+	}
+	stacks := make([]string, 0, len(totals))
+	for stack := range totals {
+		stacks = append(stacks, stack)
+	}
+	sort.Strings(stacks)
+	ew := &errWriter{w: w}
+	for _, stack := range stacks {
+		fmt.Fprintf(ew, "%s %d\n", stack, totals[stack])
+	}
+	return ew.err
+}
+
+// flameColor returns a warm color for the named function, the same
+// for each run of the program.
+func flameColor(name string) string {
+	h := fnv.New32a()
+	io.WriteString(h, name)
+	v := h.Sum32()
+	return fmt.Sprintf("rgb(%d,%d,%d)", 205+v%50, 80+(v>>8)%150, (v>>16)%55)
+}
+
+// errWriter records the first error returned by w.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (e *errWriter) Write(buf []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	n, err := e.w.Write(buf)
+	e.err = err
+	return n, err
+}
+
+// locationNames returns the names of the functions at l, innermost
+// first, or its address if it has not been symbolized.
+func locationNames(l *pprofile.Location) []string {
+	var names []string
+	for _, ln := range l.Line {
+		if ln.Function != nil && ln.Function.Name != "" {
+			names = append(names, ln.Function.Name)
+		}
+	}
+	if len(names) == 0 {
+		names = append(names, fmt.Sprintf("%#x", l.Address))
+	}
+	return names
+}
+
+// formatValue formats v in the given unit.
+func formatValue(v int64, unit string) string {
+	switch unit {
+	case "nanoseconds":
+		return time.Duration(v).String()
+	case "bytes":
+		switch {
+		case v >= 1<<30 || v <= -1<<30:
+			return fmt.Sprintf("%.2fGB", float64(v)/(1<<30))
+		case v >= 1<<20 || v <= -1<<20:
+			return fmt.Sprintf("%.2fMB", float64(v)/(1<<20))
+		case v >= 1<<10 || v <= -1<<10:
+			return fmt.Sprintf("%.2fkB", float64(v)/(1<<10))
+		}
+		return fmt.Sprintf("%dB", v)
+	}
+	return fmt.Sprint(v)
+}
+
+// percent formats v as a percentage of total.
+func percent(v, total int64) string {
+	if total == 0 {
+		return "0%"
+	}
+	return fmt.Sprintf("%.2f%%", 100*float64(v)/float64(total))
+}
@@ -0,0 +1,144 @@
+package profile
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	pprofile "github.com/google/pprof/profile"
+)
+
+// testProfile returns a small profile whose functions, locations and
+// samples are stored in the given order.
+func testProfile(reverse bool) *pprofile.Profile {
+	fns := []*pprofile.Function{
+		{ID: 1, Name: "main.a", Filename: "a.go"},
+		{ID: 2, Name: "main.b", Filename: "b.go"},
+	}
+	locs := []*pprofile.Location{
+		{ID: 1, Address: 0x10, Line: []pprofile.Line{{Function: fns[0], Line: 1}}},
+		{ID: 2, Address: 0x20, Line: []pprofile.Line{{Function: fns[1], Line: 2}}},
+	}
+	samples := []*pprofile.Sample{
+		{Location: []*pprofile.Location{locs[0]}, Value: []int64{1}},
+		{Location: []*pprofile.Location{locs[1], locs[0]}, Value: []int64{2}, Label: map[string][]string{"k": {"v"}}},
+		{Location: []*pprofile.Location{locs[1]}, Value: []int64{3}},
+	}
+	if reverse {
+		fns[0].ID, fns[1].ID = 2, 1
+		locs[0].ID, locs[1].ID = 2, 1
+		fns[0], fns[1] = fns[1], fns[0]
+		locs[0], locs[1] = locs[1], locs[0]
+		samples[0], samples[2] = samples[2], samples[0]
+	}
+	return &pprofile.Profile{
+		SampleType: []*pprofile.ValueType{{Type: "count", Unit: "count"}},
+		PeriodType: &pprofile.ValueType{Type: "count", Unit: "count"},
+		Period:     1,
+		Sample:     samples,
+		Location:   locs,
+		Function:   fns,
+		TimeNanos:  1,
+	}
+}
+
+func TestSortProfile(t *testing.T) {
+	var a, b bytes.Buffer
+	if err := sortProfile(testProfile(false)).Write(&a); err != nil {
+		t.Fatal(err)
+	}
+	if err := sortProfile(testProfile(true)).Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Errorf("sortProfile: serialized profiles differ")
+	}
+}
+
+func TestDelta(t *testing.T) {
+	base := testProfile(false)
+	cur := testProfile(false)
+	cur.TimeNanos = 11
+	for _, s := range cur.Sample[1:] {
+		s.Value[0] *= 2
+	}
+	d, err := delta(cur, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.DurationNanos != 10 {
+		t.Errorf("delta: wanted duration 10, got %d", d.DurationNanos)
+	}
+	var got []int64
+	for _, s := range sortProfile(d).Sample {
+		got = append(got, s.Value[0])
+	}
+	if len(got) != 2 || got[0]+got[1] != 5 {
+		t.Errorf("delta: wanted sample values [2 3], got %v", got)
+	}
+}
+
+func TestTextReport(t *testing.T) {
+	var buf bytes.Buffer
+	if err := textReport(&buf, "test.pprof", testProfile(false), 10); err != nil {
+		t.Fatal(err)
+	}
+	report := buf.String()
+	for _, want := range []string{
+		"File: test.pprof\n",
+		"Total: 6\n",
+		"         5  83.33%  83.33%          5  83.33%  main.b\n",
+		"         1  16.67% 100.00%          3  50.00%  main.a\n",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("textReport: wanted %q in report:\n%s", want, report)
+		}
+	}
+
+	prof := testProfile(false)
+	for _, l := range prof.Location {
+		l.Line = nil
+	}
+	if err := textReport(&buf, "test.pprof", prof, 10); err != errNoSymbols {
+		t.Errorf("textReport: wanted %v, got %v", errNoSymbols, err)
+	}
+}
+
+func TestFlamegraph(t *testing.T) {
+	var buf bytes.Buffer
+	if err := flamegraph(&buf, testProfile(false)); err != nil {
+		t.Fatal(err)
+	}
+	svg := buf.String()
+	for _, want := range []string{
+		"<svg ",
+		"<title>all (6, 100.00%)</title>",
+		"<title>main.a (3, 50.00%)</title>",
+		"<title>main.b (2, 33.33%)</title>",
+		"<title>main.b (3, 50.00%)</title>",
+		"</svg>\n",
+	} {
+		if !strings.Contains(svg, want) {
+			t.Errorf("flamegraph: wanted %q in svg:\n%s", want, svg)
+		}
+	}
+
+	prof := testProfile(false)
+	for _, l := range prof.Location {
+		l.Line = nil
+	}
+	if err := flamegraph(&buf, prof); err != errNoSymbols {
+		t.Errorf("flamegraph: wanted %v, got %v", errNoSymbols, err)
+	}
+}
+
+func TestFoldedStacks(t *testing.T) {
+	var buf bytes.Buffer
+	if err := foldedStacks(&buf, testProfile(false)); err != nil {
+		t.Fatal(err)
+	}
+	want := "main.a 1\nmain.a;main.b 2\nmain.b 3\n"
+	if got := buf.String(); got != want {
+		t.Errorf("foldedStacks: wanted %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,11 @@
+package profile
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocate reserves n bytes of disk space for f.
+func preallocate(f *os.File, n int64) error {
+	return syscall.Fallocate(int(f.Fd()), 0, 0, n)
+}
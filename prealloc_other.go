@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package profile
+
+import "os"
+
+// preallocate is a no-op on platforms without fallocate.
+func preallocate(f *os.File, n int64) error { return nil }
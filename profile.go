@@ -3,17 +3,39 @@
 package profile
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"runtime/debug"
 	"runtime/pprof"
 	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	texttemplate "text/template"
+	"time"
 
 	"github.com/felixge/fgprof"
+	pprofile "github.com/google/pprof/profile"
 )
 
 const (
@@ -25,36 +47,426 @@ const (
 	threadCreateMode
 	goroutineMode
 	clockMode
+	pmuMode
+	flightMode
+	customMode
 )
 
 // Profile represents an active profiling session.
 type Profile struct {
-	// quiet suppresses informational messages during profiling.
-	quiet bool
+	// verbosity controls which messages are logged during profiling.
+	verbosity int
+
+	// logger receives the messages logged, in place of the
+	// standard logger, if set.
+	logger Printer
 
 	// noShutdownHook controls whether the profiling package should
 	// hook SIGINT to write profiles cleanly.
 	noShutdownHook bool
 
+	// shutdownHook forces the shutdown hook to be installed even
+	// when running under go test.
+	shutdownHook bool
+
+	// signalAction holds what the shutdown hook does on SIGINT.
+	signalAction int
+
+	// dirPolicy holds what Start does when the output directory
+	// already holds profiles.
+	dirPolicy int
+
 	// mode holds the type of profiling that will be made
 	mode int
 
+	// extra holds additional modes which are profiled alongside mode.
+	extra []int
+
 	// path holds the base path where various profiling files are  written.
 	// If blank, the base path will be generated by ioutil.TempDir.
 	path string
 
+	// tempRoot holds the directory in which the base path is
+	// generated if path is blank. If blank, os.TempDir is used.
+	tempRoot string
+
+	// cpuProfileRate holds the cpu profiling rate in Hz.
+	// If zero, the runtime default is used.
+	cpuProfileRate int
+
+	// gcPercent holds the garbage collection target percentage
+	// set for the session, if setGCPercent.
+	gcPercent    int
+	setGCPercent bool
+
+	// onStart holds the functions called with the output directory
+	// before profiling begins.
+	onStart []func(path string)
+
+	// onStop holds the functions called with the files written
+	// once the session has stopped.
+	onStop []func(files []string)
+
+	// beforeStart and afterStop hold the functions called as the
+	// session starts and once it has stopped.
+	beforeStart []func(start time.Time)
+	afterStop   []func(r Results)
+
+	// customProfile holds the name of the profile written by
+	// CustomProfile.
+	customProfile string
+
+	// flightWindow is the minimum age of the events kept by the
+	// flight recorder. flight holds the recorder while it runs.
+	flightWindow time.Duration
+	flight       *flightRecorder
+
+	// tar receives a tar stream of the files written, which are
+	// held in memory until Stop, if not nil.
+	tar io.Writer
+
+	// invalid holds the first invalid option setting, reported
+	// by Start and Validate.
+	invalid error
+
+	// cgoHint enables a hint about incomplete stacks when
+	// cgo calls are made while cpu profiling.
+	cgoHint bool
+
 	// memProfileRate holds the rate for the memory profile.
 	memProfileRate int
 
+	// heapDelta writes the growth of the heap between Start and
+	// Stop, from heapBase, the heap profile captured at Start.
+	heapDelta bool
+	heapBase  *pprofile.Profile
+
+	// mutexProfileFraction and blockProfileRate hold the rates of
+	// the mutex and block profiles. If zero, 1 is used.
+	mutexProfileFraction int
+	blockProfileRate     int
+
 	// memProfileType holds the profile type for memory
 	// profiles. Allowed values are `heap` and `allocs`.
 	memProfileType string
 
+	// traceCategory and traceMessage are logged to the execution
+	// trace when it starts and stops.
+	traceCategory string
+	traceMessage  string
+
+	// pmuEvent holds the hardware event sampled by PMUProfile.
+	pmuEvent string
+
+	// transform is applied to the memory, mutex, block, thread
+	// creation and goroutine profiles before they are written.
+	transform func([]byte) ([]byte, error)
+
+	// gcBeforeSnapshot runs a garbage collection before memory
+	// profiles are written.
+	gcBeforeSnapshot bool
+
+	// compressOver holds the size in bytes above which profile files
+	// are gzip compressed on Stop. It is only used if compress is set.
+	compressOver int
+	compress     bool
+
+	// compressor, if set, wraps execution trace files as they are
+	// written, which are named with the extension compressExt.
+	compressor  func(io.Writer) (io.WriteCloser, error)
+	compressExt string
+
+	// uploadURL holds the URL completed profile files are
+	// POSTed to on Stop.
+	uploadURL string
+
+	// labelFilters restricts pprof profiles to samples with
+	// matching labels on Stop.
+	labelFilters []*labelFilter
+
+	// deterministic sorts pprof profiles into a stable order on Stop.
+	deterministic bool
+
+	// comment is added to the comments of each pprof profile on Stop.
+	comment string
+
+	// meta holds the metadata written to meta.json at Start and
+	// added to the comments of each pprof profile.
+	meta map[string]string
+
+	// affinityNote records the cpu affinity of the process at Start
+	// in affinity, added to the comments of each pprof profile.
+	affinityNote bool
+	affinity     string
+
+	// invocation writes the command line, and the environment
+	// variables matching invocationEnv, to invocation.txt at Start.
+	invocation    bool
+	invocationEnv []string
+
+	// webUI opens each profile in the pprof or trace web UI on Stop.
+	webUI bool
+
+	// textReport writes a summary of each pprof profile to
+	// report.txt on Stop.
+	textReport bool
+
+	// omitEmpty removes the lookup profiles without samples on Stop.
+	omitEmpty bool
+
+	// verify parses each file written on Stop.
+	verify bool
+
+	// overhead, if not nil, records the cost of the session.
+	overhead *Overhead
+
+	// latestSymlink links <mode>-latest to the newest file of
+	// each mode on Stop.
+	latestSymlink bool
+
+	// indexHTML writes an index.html listing the files written
+	// on Stop.
+	indexHTML bool
+
+	// memViews writes a text report of the inuse_space and the
+	// alloc_space views of each memory profile on Stop.
+	memViews bool
+
+	// foldedStacks writes the stacks of each cpu and memory
+	// profile in the folded format on Stop.
+	foldedStacks bool
+
+	// flamegraph writes flame.svg, a flame graph of the cpu or
+	// memory profile, on Stop.
+	flamegraph bool
+
+	// rotateSize, rotateBackups and rotateAge hold the limits set
+	// by Rotation on the size of streamed files, on the number of
+	// older files kept of each profile, and on the age of the files
+	// kept in the output directory.
+	rotateSize    int64
+	rotateBackups int
+	rotateAge     time.Duration
+
+	// maxFiles and maxAge hold the limits set by MaxFiles and MaxAge
+	// on the profile files kept in the output directory.
+	maxFiles int
+	maxAge   time.Duration
+
+	// maxBytes holds the number of bytes after which streamed
+	// profiles are stopped automatically, written counts the bytes
+	// streamed so far.
+	maxBytes int64
+	written  int64
+
+	// preallocate holds the number of bytes reserved for each
+	// profile file when it is created.
+	preallocate int64
+
+	// mergeOnStop merges rotated cpu and clock profiles on Stop.
+	mergeOnStop bool
+
+	// resetOnFlush makes Flush write the change in the block and
+	// mutex profiles since the previous flush; last holds the
+	// previous state of each profile.
+	resetOnFlush bool
+	last         map[string]*pprofile.Profile
+
+	// recordDuration sets the duration of the heap, block and
+	// mutex profiles written to the time since profiling started.
+	recordDuration bool
+
+	// continuousInterval, if non zero, is the interval at which
+	// heap and goroutine snapshots are written until Stop, keeping
+	// the most recent continuousKeep of each.
+	continuousInterval time.Duration
+	continuousKeep     int
+
+	// continuousCPU splits the cpu profile into a file per interval,
+	// rotated by rotateCPU, which returns the name of the file closed.
+	continuousCPU bool
+	rotateCPU     func(next string) (string, bool)
+
+	// continuousFiles holds the files written by Continuous, and the
+	// cpu windows, of each profile, oldest first. Guarded by mu.
+	continuousFiles map[string][]string
+
+	// done is closed when the session stops.
+	done chan struct{}
+
+	// signal, if not nil, starts an isolated session of signalMode,
+	// stopped after signalDuration, each time it is received in place
+	// of profiling on Start. capturing is non zero while one runs,
+	// captures waits for it and the handler. capture is set on
+	// those sessions.
+	signal         os.Signal
+	signalMode     func(*Profile)
+	signalDuration time.Duration
+	capturing      uint32
+	captures       sync.WaitGroup
+	capture        bool
+
+	// ringSize holds the number of Flush snapshots of each profile
+	// kept in memory, in rings, until Stop. If zero snapshots are
+	// written as they are taken.
+	ringSize int
+	rings    []*ring
+
+	// autoName prefixes profile file names with the program name.
+	autoName bool
+
+	// nameTemplate, if set, makes the names of the files written.
+	// nameTime is the time they are named for, when the session
+	// became active.
+	nameTemplate *texttemplate.Template
+	nameTime     time.Time
+
+	// reason is inserted before the extension of file names.
+	reason string
+
+	// hostPID, the host name and process id, is inserted before the
+	// extension of file names, ahead of reason.
+	hostPID string
+
+	// heapLimit is the heap size at which the session is not
+	// started, or is stopped, set by DisableUnderPressure.
+	heapLimit uint64
+
+	// duration is the time after which the session is stopped,
+	// set by Duration.
+	duration time.Duration
+
+	// delay is the time after Start at which profiling begins,
+	// set by Delay.
+	delay time.Duration
+
+	// correlationID prefixes file names and is recorded in the
+	// comments of each pprof profile.
+	correlationID string
+
+	// sync flushes profile files to stable storage before closing them.
+	sync bool
+
+	// minFreeSpace holds the number of bytes which must be free in
+	// the output directory for profiling to start.
+	minFreeSpace uint64
+
+	// fs holds the file system profiles are written to.
+	fs FileSystem
+
+	// dirAttempts holds the number of attempts made to create the
+	// output directory.
+	dirAttempts int
+
+	// jsonLog receives the start and stop events as JSON objects
+	// in place of the informational messages.
+	jsonLog io.Writer
+
+	// streams holds the writers set by WriteTo for each mode.
+	streams map[int]io.Writer
+
+	// names holds the file names set by ProfileName for each mode.
+	names map[int]string
+
+	// dirMode and fileMode, if not zero, are the permissions of the
+	// directories and files created.
+	dirMode, fileMode os.FileMode
+
+	// atomic writes files under temporary names, renamed into place
+	// once complete.
+	atomic bool
+
+	// logEvent receives the start and stop events in place of the
+	// informational messages, see Slog.
+	logEvent func(event)
+
+	// tee holds additional destinations for the cpu profile.
+	tee []io.Writer
+
+	// file, if not nil, is written by the profiling mode in
+	// place of a file in the output directory.
+	file *os.File
+
+	// isolated sessions may run alongside other sessions.
+	isolated bool
+
+	// labels holds the pprof labels, as key value pairs, applied
+	// to the goroutine calling Start for the duration of the session.
+	labels []string
+
+	// labelCtx and labelKeys hold the context, and the keys looked
+	// up in it by extractLabel, of LabelsFromContext.
+	labelCtx     context.Context
+	labelKeys    []string
+	extractLabel func(ctx context.Context, key string) (string, bool)
+
+	// minGoroutines holds the number of goroutines which must be
+	// running for profiling to begin, waiting at most
+	// minGoroutinesTimeout if it is non zero.
+	minGoroutines        int
+	minGoroutinesTimeout time.Duration
+
+	// startAfter, if not nil, holds a counter which must reach
+	// startAfterThreshold for profiling to begin.
+	startAfter          *int64
+	startAfterThreshold int64
+
+	// when holds a condition which must be true at Start for
+	// profiling to take place.
+	when func() bool
+
+	// skipped is set if the session was not started because
+	// its when condition was false.
+	skipped bool
+
+	// lazy defers starting the session until Begin is called;
+	// begun is non zero once it has been started or stopped.
+	lazy  bool
+	begun uint32
+
+	// strictStop panics if Stop is called more than once.
+	strictStop bool
+
+	// files holds the profile files written during this session.
+	files []*output
+
+	// start and end record the wall clock time at which
+	// profiling started and stopped.
+	start, end time.Time
+
 	// closer holds a cleanup function that run after each profile
 	closer func()
 
+	// flush holds a function that writes the current profiling
+	// data without stopping the session.
+	flush func()
+
+	// flushes counts the calls to flush for each profile file,
+	// numbering the files written.
+	flushes map[string]int
+
+	// numbered maps the names of the files written to the names
+	// chosen for them by the Number directory policy.
+	numbered map[string]string
+
+	// mu serialises Flush and Stop.
+	mu sync.Mutex
+
 	// stopped records if a call to profile.Stop has been made
 	stopped uint32
+
+	// stopDone is closed once the first call to stop returns.
+	stopDone chan struct{}
+
+	// stopping is non zero while stop writes the profiles, and
+	// stopErr holds the first warning logged meanwhile, or by errorf.
+	stopping uint32
+	errMu    sync.Mutex
+	stopErr  error
+
+	// stopCalls is non zero once Stop has been called by the caller
+	// of a StrictStop session.
+	stopCalls uint32
 }
 
 // NoShutdownHook controls whether the profiling package should
@@ -62,26 +474,296 @@ type Profile struct {
 // Programs with more sophisticated signal handling should set
 // this to true and ensure the Stop() function returned from Start()
 // is called during shutdown.
+//
+// The shutdown hook is not installed by default when the program
+// is a test binary built by go test, see ShutdownHook.
 func NoShutdownHook(p *Profile) { p.noShutdownHook = true }
 
-// Quiet suppresses informational messages during profiling.
-func Quiet(p *Profile) { p.quiet = true }
+// ShutdownHook forces the SIGINT shutdown hook to be installed
+// even when running under go test, where it is otherwise disabled
+// to avoid interfering with the test framework.
+func ShutdownHook(p *Profile) { p.shutdownHook = true }
+
+// Signal actions, see SignalAction.
+const (
+	// FlushAndExit stops the session, writing the profiles, and
+	// exits the program. It is the default.
+	FlushAndExit = iota
+
+	// FlushAndContinue flushes the session, as Flush does, and
+	// keeps profiling until the next signal or Stop.
+	FlushAndContinue
+)
+
+// Directory policies, see DirPolicy.
+const (
+	// Overwrite replaces the profiles of earlier runs which have
+	// the same names. It is the default.
+	Overwrite = iota
+
+	// Fail stops Start if the output directory holds profiles.
+	Fail
+
+	// Number numbers each file whose name is taken, e.g. cpu.1.pprof
+	// and then cpu.2.pprof when cpu.pprof exists.
+	Number
+
+	// Clean removes the profiles in the output directory at Start.
+	Clean
+)
+
+// DirPolicy sets what Start does when the output directory already
+// holds profiles, for programs which reuse a ProfilePath across runs.
+// A profile is a file whose extension is .pprof, .out or .trace,
+// optionally compressed. Fail and Clean need the operating system's
+// file system, see FS, and other files are left alone.
+func DirPolicy(policy int) func(*Profile) {
+	return func(p *Profile) {
+		p.dirPolicy = policy
+	}
+}
+
+// profiles returns the regular files in dir with a profile extension.
+func profiles(dir string) ([]os.FileInfo, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []os.FileInfo
+	for _, e := range entries {
+		name := trimCompressed(e.Name())
+		for _, ext := range profileExts {
+			if e.Mode().IsRegular() && filepath.Ext(name) == ext {
+				files = append(files, e)
+				break
+			}
+		}
+	}
+	return files, nil
+}
+
+// checkDir returns an error if the Fail directory policy is set and
+// dir holds profiles.
+func (p *Profile) checkDir(dir string) error {
+	if _, ok := p.fs.(osFS); !ok || p.dirPolicy != Fail {
+		return nil
+	}
+	files, err := profiles(dir)
+	if err == nil && len(files) > 0 {
+		err = fmt.Errorf("%q already holds profiles, e.g. %s", dir, files[0].Name())
+	}
+	return err
+}
+
+// clean removes the profiles in the output directory.
+func (p *Profile) clean() {
+	files, err := profiles(p.path)
+	if err != nil {
+		p.warnf("profile: could not clean %q: %v", p.path, err)
+		return
+	}
+	for _, e := range files {
+		fn := filepath.Join(p.path, e.Name())
+		if err := p.fs.Remove(fn); err != nil {
+			p.warnf("profile: could not remove %q: %v", fn, err)
+			continue
+		}
+		p.logf("profile: removed %s", fn)
+	}
+}
+
+// exists reports whether fn, or its compressed form, is in the
+// file system.
+func (p *Profile) exists(fn string) bool {
+	names := []string{fn, fn + ".gz"}
+	if p.compressExt != "" && p.compressExt != ".gz" {
+		names = append(names, fn+p.compressExt)
+	}
+	for _, name := range names {
+		if f, err := p.fs.Open(name); err == nil {
+			f.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// number returns the name the Number directory policy chooses for fn,
+// the first of fn, fn.1, fn.2 and so on, ahead of the extension, not
+// taken when fn was first named.
+func (p *Profile) number(fn string) string {
+	if name, ok := p.numbered[fn]; ok {
+		return name
+	}
+	if p.numbered == nil {
+		p.numbered = make(map[string]string)
+	}
+	name := fn
+	ext := filepath.Ext(fn)
+	for i := 1; p.exists(name); i++ {
+		name = fmt.Sprintf("%s.%d%s", strings.TrimSuffix(fn, ext), i, ext)
+	}
+	p.numbered[fn] = name
+	return name
+}
+
+// SignalAction sets what the shutdown hook does when the program
+// receives SIGINT. With FlushAndContinue each SIGINT writes a
+// snapshot, so the program must be stopped by other means.
+func SignalAction(action int) func(*Profile) {
+	return func(p *Profile) {
+		p.signalAction = action
+	}
+}
+
+// Verbosity levels, see Verbosity.
+const (
+	// LevelSilent logs nothing but fatal errors.
+	LevelSilent = iota
+
+	// LevelWarn logs warnings, such as failed uploads.
+	LevelWarn
+
+	// LevelInfo logs warnings and informational messages, such as
+	// the start and stop of profiling. It is the default.
+	LevelInfo
+)
+
+// Verbosity sets which messages are logged during profiling to those
+// at or below level.
+func Verbosity(level int) func(*Profile) {
+	return func(p *Profile) {
+		p.verbosity = level
+	}
+}
+
+// Quiet suppresses informational messages and warnings during
+// profiling. It is short for Verbosity(LevelSilent).
+func Quiet(p *Profile) { p.verbosity = LevelSilent }
+
+// Printer is the interface of the loggers accepted by Logger.
+// It is satisfied by *log.Logger.
+type Printer interface {
+	Printf(format string, v ...interface{})
+}
+
+// Logger routes the messages logged during profiling to l rather than
+// to the standard logger, so that they reach the program's own logging.
+// Verbosity still selects which messages are logged.
+func Logger(l Printer) func(*Profile) {
+	return func(p *Profile) {
+		p.logger = l
+	}
+}
 
 // CPUProfile enables cpu profiling.
 // It disables any previous profiling settings.
 func CPUProfile(p *Profile) { p.mode = cpuMode }
 
-// DefaultMemProfileRate is the default memory profiling rate.
+// maxCPUProfileRate is the highest cpu profiling rate accepted by
+// CPUProfileRate. Few platforms can deliver profiling signals any faster.
+const maxCPUProfileRate = 10000
+
+// CPUProfileRate enables cpu profiling at the preferred rate, in Hz.
+// The runtime default is 100 Hz.
+// It disables any previous profiling settings.
+//
+// The rate is set before the cpu profile is started, so that it takes
+// effect. As a result the runtime prints "runtime: cannot set cpu
+// profile rate until previous profile has finished" to stderr as the
+// profile starts: the rate it could not set is its own default, and
+// the rate given here is the one profiled at, so the message is
+// harmless.
+func CPUProfileRate(hz int) func(*Profile) {
+	return func(p *Profile) {
+		if hz <= 0 || hz > maxCPUProfileRate {
+			p.fail(fmt.Errorf("invalid cpu profile rate %d Hz, must be between 1 and %d", hz, maxCPUProfileRate))
+		}
+		p.cpuProfileRate = hz
+		p.mode = cpuMode
+	}
+}
+
+// CgoHint logs a one time hint on Stop if cgo calls were made while
+// cpu profiling. The Go runtime cannot unwind C stacks on its own, so
+// time spent in C code is attributed to opaque frames unless a cgo
+// traceback function has been registered with runtime.SetCgoTraceback,
+// for example by importing github.com/ianlancetaylor/cgosymbolizer.
+func CgoHint(p *Profile) { p.cgoHint = true }
+
+// DefaultMemProfileRate is the memory profiling rate used by MemProfile.
 // See also http://golang.org/pkg/runtime/#pkg-variables
-const DefaultMemProfileRate = 4096
+//
+// A program may change it once, before any session is started, for
+// example in an init function. To change it while Start may be called
+// concurrently, use SetDefaultMemProfileRate.
+var DefaultMemProfileRate = 4096
+
+// defaultMemProfileRateMu guards DefaultMemProfileRate against
+// concurrent modification by SetDefaultMemProfileRate.
+var defaultMemProfileRateMu sync.Mutex
+
+// SetDefaultMemProfileRate sets DefaultMemProfileRate to rate. It is
+// safe to call while sessions are being started.
+func SetDefaultMemProfileRate(rate int) {
+	defaultMemProfileRateMu.Lock()
+	defer defaultMemProfileRateMu.Unlock()
+	DefaultMemProfileRate = rate
+}
+
+// defaultMemProfileRate returns DefaultMemProfileRate.
+func defaultMemProfileRate() int {
+	defaultMemProfileRateMu.Lock()
+	defer defaultMemProfileRateMu.Unlock()
+	return DefaultMemProfileRate
+}
 
 // MemProfile enables memory profiling.
 // It disables any previous profiling settings.
 func MemProfile(p *Profile) {
-	p.memProfileRate = DefaultMemProfileRate
+	p.memProfileRate = defaultMemProfileRate()
 	p.mode = memMode
 }
 
+// HeapDelta enables memory profiling and writes, in addition to
+// mem.pprof, the difference between the heap profiles at Start and at
+// Stop to mem-delta.pprof, so that steady state allocations cancel out
+// and only the growth of the heap remains, as when hunting a leak.
+// A garbage collection is run before each heap profile is captured.
+// It disables any previous profiling settings.
+func HeapDelta(p *Profile) {
+	if p.memProfileRate == 0 {
+		p.memProfileRate = defaultMemProfileRate()
+	}
+	p.heapDelta = true
+	p.mode = memMode
+}
+
+// writeHeapDelta writes the growth of the heap since Start.
+func (p *Profile) writeHeapDelta() {
+	fn := p.filename("mem-delta.pprof")
+	runtime.GC()
+	cur, err := capture("heap")
+	if err == nil {
+		cur, err = delta(cur, p.heapBase)
+	}
+	if err != nil {
+		p.warnf("profile: could not compute heap delta: %v", err)
+		return
+	}
+	f, err := p.create(memMode, fn)
+	if err != nil {
+		p.warnf("profile: could not create heap delta profile %q: %v", fn, err)
+		return
+	}
+	if err := p.transformTo(f, cur.Write); err != nil {
+		p.warnf("profile: could not write heap delta profile %q: %v", fn, err)
+	}
+	if p.close(f) == nil {
+		p.logf("profile: heap delta written to %s", fn)
+	}
+}
+
 // MemProfileRate enables memory profiling at the preferred rate.
 // It disables any previous profiling settings.
 func MemProfileRate(rate int) func(*Profile) {
@@ -92,35 +774,178 @@ func MemProfileRate(rate int) func(*Profile) {
 }
 
 // MemProfileHeap changes which type of memory profiling to profile
-// the heap.
+// the heap. Unless a rate has been set it profiles at
+// DefaultMemProfileRate.
 func MemProfileHeap(p *Profile) {
+	if p.memProfileRate == 0 {
+		p.memProfileRate = defaultMemProfileRate()
+	}
 	p.memProfileType = "heap"
 	p.mode = memMode
 }
 
 // MemProfileAllocs changes which type of memory to profile
-// allocations.
+// allocations, reporting the space allocated since the program
+// started rather than the space in use. Unless a rate has been set
+// it profiles at DefaultMemProfileRate.
 func MemProfileAllocs(p *Profile) {
+	if p.memProfileRate == 0 {
+		p.memProfileRate = defaultMemProfileRate()
+	}
 	p.memProfileType = "allocs"
 	p.mode = memMode
 }
 
+// Transform applies fn to the encoded memory, mutex, block, thread
+// creation and goroutine profiles before they are written, on Stop and
+// on Flush, for example to redact function names or file paths before
+// profiles are shared. If fn returns an error the profile is not written.
+// Transform is not supported by the streamed cpu and clock profiles,
+// or by traces.
+func Transform(fn func([]byte) ([]byte, error)) func(*Profile) {
+	return func(p *Profile) {
+		p.transform = fn
+	}
+}
+
+// GCPercent sets the garbage collection target percentage, as
+// debug.SetGCPercent does, for the duration of the session, and
+// restores the previous setting on Stop. A low percentage collects
+// more often, to investigate the heap, a negative one disables the
+// collector. This changes the behavior, and the performance, of the
+// program while it is profiled.
+func GCPercent(pct int) func(*Profile) {
+	return func(p *Profile) {
+		p.gcPercent = pct
+		p.setGCPercent = true
+	}
+}
+
+// GCBeforeSnapshot runs a garbage collection before the memory profile
+// is written, on Stop and on Flush, so that it reflects the live heap
+// at that moment rather than at the most recent collection. This is the
+// equivalent of the gc=1 parameter of net/http/pprof. Each collection
+// adds a stop the world pause.
+func GCBeforeSnapshot(p *Profile) { p.gcBeforeSnapshot = true }
+
 // MutexProfile enables mutex profiling.
 // It disables any previous profiling settings.
 func MutexProfile(p *Profile) { p.mode = mutexMode }
 
+// MutexProfileFraction enables mutex profiling, reporting on average
+// 1/rate of the contention events, as runtime.SetMutexProfileFraction
+// does. The previous fraction is restored on Stop.
+// It disables any previous profiling settings.
+func MutexProfileFraction(rate int) func(*Profile) {
+	return func(p *Profile) {
+		p.mutexProfileFraction = rate
+		p.mode = mutexMode
+	}
+}
+
 // BlockProfile enables block (contention) profiling.
 // It disables any previous profiling settings.
 func BlockProfile(p *Profile) { p.mode = blockMode }
 
+// BlockProfileRate enables block profiling, sampling on average one
+// blocking event per rate nanoseconds spent blocked, as
+// runtime.SetBlockProfileRate does. Block profiling is disabled on Stop.
+// It disables any previous profiling settings.
+//
+// The mutex and block rates are independent, so both profiles may be
+// tuned in one session:
+//
+//	profile.Start(profile.MutexProfileFraction(10), profile.Also(profile.BlockProfileRate(10000)))
+func BlockProfileRate(rate int) func(*Profile) {
+	return func(p *Profile) {
+		p.blockProfileRate = rate
+		p.mode = blockMode
+	}
+}
+
 // Trace profile enables execution tracing.
 // It disables any previous profiling settings.
+// Each profile written while tracing, such as a heap snapshot taken by
+// Flush, is marked in the trace by a log in the profile category, e.g.
+// "heap profile written", placing it on the timeline of go tool trace.
 func TraceProfile(p *Profile) { p.mode = traceMode }
 
-// ThreadcreationProfile enables thread creation profiling..
+// TraceLog logs message in category to the execution trace when
+// tracing starts, as "message: start", and when it stops, as
+// "message: stop", marking the profiling window in go tool trace.
+func TraceLog(category, message string) func(*Profile) {
+	return func(p *Profile) {
+		p.traceCategory = category
+		p.traceMessage = message
+	}
+}
+
+// FlightRecorder keeps the most recent window of the execution trace
+// in memory, with the low overhead flight recorder of runtime/trace,
+// rather than writing a full trace. Snapshot and Flush write the window
+// to a new numbered file, e.g. flight.1.trace, for example when a rare
+// event is detected. Nothing is written on Stop. Flight recording
+// requires Go 1.25 or later; on older versions the failure is logged
+// and the session continues without it.
+// It disables any previous profiling settings.
+func FlightRecorder(window time.Duration) func(*Profile) {
+	return func(p *Profile) {
+		p.flightWindow = window
+		p.mode = flightMode
+	}
+}
+
+// Snapshot writes the window of the execution trace kept by
+// FlightRecorder to the next numbered file after flight.trace in the
+// output directory, and returns its name.
+func (p *Profile) Snapshot() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if atomic.LoadUint32(&p.stopped) != 0 || p.flight == nil {
+		return "", errors.New("profile: no flight recorder running")
+	}
+	return p.snapshotFlight()
+}
+
+// snapshotFlight writes the flight recorder window to a new file.
+func (p *Profile) snapshotFlight() (string, error) {
+	fn := p.next(p.traceFile(flightMode, p.filename(p.baseName(flightMode, "flight.trace"))))
+	f, err := p.create(flightMode, fn)
+	if err != nil {
+		return "", fmt.Errorf("profile: could not create flight recorder snapshot %q: %v", fn, err)
+	}
+	if err := p.flight.writeTo(f); err != nil {
+		p.close(f)
+		return "", fmt.Errorf("profile: could not write flight recorder snapshot %q: %v", fn, err)
+	}
+	if err := p.close(f); err != nil {
+		return "", fmt.Errorf("profile: could not write flight recorder snapshot %q: %v", fn, err)
+	}
+	p.logf("profile: flight recorder snapshot written, %s", fn)
+	return fn, nil
+}
+
+// CustomProfile enables profiling of the user defined profile name,
+// created with pprof.NewProfile, writing it to <name>.pprof on Stop.
+// Start fails if no profile of that name has been registered.
+// Only one custom profile may be written by a session.
+// It disables any previous profiling settings.
+func CustomProfile(name string) func(*Profile) {
+	return func(p *Profile) {
+		p.customProfile = name
+		p.mode = customMode
+	}
+}
+
+// ThreadcreationProfile enables thread creation profiling, writing the
+// stacks which created new operating system threads to threadcreation.pprof.
 // It disables any previous profiling settings.
 func ThreadcreationProfile(p *Profile) { p.mode = threadCreateMode }
 
+// ThreadcreateProfile is ThreadcreationProfile, named after the
+// runtime/pprof profile it writes, pprof.Lookup("threadcreate").
+func ThreadcreateProfile(p *Profile) { ThreadcreationProfile(p) }
+
 // GoroutineProfile enables goroutine profiling.
 // It disables any previous profiling settings.
 func GoroutineProfile(p *Profile) { p.mode = goroutineMode }
@@ -129,199 +954,3802 @@ func GoroutineProfile(p *Profile) { p.mode = goroutineMode }
 // It disables any previous profiling settings.
 func ClockProfile(p *Profile) { p.mode = clockMode }
 
-// ProfilePath controls the base path where various profiling
-// files are written. If blank, the base path will be generated
-// by ioutil.TempDir.
-func ProfilePath(path string) func(*Profile) {
+// PMUProfile enables sampling of the named hardware event, one of
+// cycles, instructions, cache-references, cache-misses, branches
+// or branch-misses, using the Linux perf_event_open interface.
+// The cpu-clock software event, sampled every millisecond of cpu
+// time, is available where hardware events are not. The
+// profile is written in pprof format and counts user space events.
+// If the event cannot be sampled, because the platform is not Linux,
+// the hardware does not support it, or the process lacks permission,
+// the failure is logged and the session continues without it.
+// It disables any previous profiling settings.
+func PMUProfile(event string) func(*Profile) {
 	return func(p *Profile) {
-		p.path = path
+		p.pmuEvent = event
+		p.mode = pmuMode
 	}
 }
 
-// Stop stops the profile and flushes any unwritten data.
-func (p *Profile) Stop() {
-	if !atomic.CompareAndSwapUint32(&p.stopped, 0, 1) {
-		// someone has already called close
-		return
+// Also enables an additional profiling mode alongside the current one,
+// for example to capture an execution trace and a cpu profile of the
+// same run:
+//
+//	profile.Start(profile.TraceProfile, profile.Also(profile.CPUProfile))
+//
+// Each mode writes its own file. Profiling modes perturb one another,
+// the overhead of tracing is visible in a cpu profile taken at the
+// same time for example, so combine modes with care.
+func Also(mode func(*Profile)) func(*Profile) {
+	return func(p *Profile) {
+		primary := p.mode
+		mode(p)
+		p.extra = append(p.extra, p.mode)
+		p.mode = primary
 	}
-	p.closer()
-	atomic.StoreUint32(&started, 0)
 }
 
-// started is non zero if a profile is running.
-var started uint32
-
-// Start starts a new profiling session.
-// The caller should call the Stop method on the value returned
-// to cleanly stop profiling.
-func Start(options ...func(*Profile)) interface {
-	Stop()
-} {
-	if !atomic.CompareAndSwapUint32(&started, 0, 1) {
-		log.Fatal("profile: Start() already called")
+// modes returns the profiling modes enabled for this session.
+func (p *Profile) modes() []int {
+	modes := []int{p.mode}
+	seen := map[int]bool{p.mode: true}
+	for _, mode := range p.extra {
+		if !seen[mode] {
+			modes = append(modes, mode)
+			seen[mode] = true
+		}
 	}
+	return modes
+}
 
-	var prof Profile
-	for _, option := range options {
-		option(&prof)
+// Permissions sets the permissions of the output directory and of the
+// files written to the operating system's file system, e.g. 0700 and
+// 0600 to keep profiles private on a shared host. A mode of zero keeps
+// the default, 0777 for directories and 0666 for files, less the umask.
+// File permissions are set exactly, even on files which already exist.
+// Directories which already exist are left alone, and temporary output
+// directories are always private.
+func Permissions(dir, file os.FileMode) func(*Profile) {
+	return func(p *Profile) {
+		p.dirMode = dir.Perm()
+		p.fileMode = file.Perm()
 	}
+}
 
-	path, err := func() (string, error) {
-		if p := prof.path; p != "" {
-			return p, os.MkdirAll(p, 0777)
-		}
-		return ioutil.TempDir("", "profile")
-	}()
+// AtomicWrites writes each file to a hidden temporary file in the
+// output directory, such as .cpu.pprof.tmp, which is renamed into
+// place once the file is complete, so that programs watching the
+// directory never see a partly written profile. Files rewritten on
+// Stop, for example by Comments, are replaced in the same way. It
+// needs the operating system's file system, see FS, and covers the
+// sessions of ProfileOnSignal.
+func AtomicWrites(p *Profile) { p.atomic = true }
 
-	if err != nil {
-		log.Fatalf("profile: could not create initial output directory: %v", err)
+// dirPerm returns the permissions output directories are created with.
+func (p *Profile) dirPerm() os.FileMode {
+	if p.dirMode != 0 {
+		return p.dirMode
 	}
+	return 0777
+}
 
-	logf := func(format string, args ...interface{}) {
-		if !prof.quiet {
-			log.Printf(format, args...)
+// filePerm returns the permissions of the files in a TarWriter archive.
+func (p *Profile) filePerm() os.FileMode {
+	if p.fileMode != 0 {
+		return p.fileMode
+	}
+	return 0644
+}
+
+// ProfilePath controls the base path where various profiling
+// files are written. If blank, the base path will be generated
+// by ioutil.TempDir.
+// The PROFILE_PATH environment variable, if set, takes precedence
+// so that output can be redirected without rebuilding the program.
+// Profiles left in the path by earlier runs are overwritten unless
+// DirPolicy(Number) is given.
+func ProfilePath(path string) func(*Profile) {
+	return func(p *Profile) {
+		p.path = path
+	}
+}
+
+// PathEnv is the environment variable which, if set, overrides
+// the base path given by ProfilePath.
+const PathEnv = "PROFILE_PATH"
+
+// TempRoot controls the directory in which the base path is generated
+// when no ProfilePath is given, for example to keep profiles on a fast
+// local disk when $TMPDIR is a network mount. If blank, the directory
+// returned by os.TempDir is used.
+func TempRoot(dir string) func(*Profile) {
+	return func(p *Profile) {
+		p.tempRoot = dir
+	}
+}
+
+// CompressOver gzip compresses each profile file on Stop if its
+// size exceeds the given number of bytes. Smaller files are left
+// uncompressed so they remain directly usable by tooling.
+// Profiles which are already gzip compressed, such as those in
+// pprof format, are not compressed again.
+func CompressOver(bytes int) func(*Profile) {
+	return func(p *Profile) {
+		p.compressOver = bytes
+		p.compress = true
+	}
+}
+
+// Compress gzip compresses execution traces as they are written,
+// to trace.out.gz and flight.trace.gz, rather than once profiling
+// stops, so long traces never reach the disk uncompressed. Profiles
+// in pprof format are left alone, as the runtime writes them gzip
+// encoded already: cpu.pprof is not compressed again, nor renamed
+// cpu.pprof.gz, and go tool pprof reads it as it is.
+func Compress(p *Profile) {
+	Compressor(".gz", func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	})(p)
+}
+
+// Compressor is like Compress, but execution traces are written
+// through the writers returned by newWriter, such as zstd.NewWriter,
+// and named with the extension ext, such as .zst. Closing the writer
+// must flush it, but not close the file beneath. Verify cannot read
+// traces compressed other than by gzip, so does not check them.
+func Compressor(ext string, newWriter func(io.Writer) (io.WriteCloser, error)) func(*Profile) {
+	return func(p *Profile) {
+		if newWriter == nil {
+			p.fail(errors.New("Compressor requires a writer"))
+			return
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		p.compressor = newWriter
+		p.compressExt = ext
+	}
+}
+
+// Upload POSTs each completed profile file to url on Stop.
+// The profiling mode is sent in the X-Profile-Mode header.
+// Upload failures are logged, the local file is always kept.
+func Upload(url string) func(*Profile) {
+	return func(p *Profile) {
+		p.uploadURL = url
+	}
+}
+
+// FilterLabels restricts the profile written on Stop to the samples
+// carrying a label key whose value matches the regular expression expr.
+// Labels are recorded by CPU and goroutine profiles, see pprof.Do, and
+// by custom profiles whose samples carry them; the other profiles of
+// the session are left whole.
+// If FilterLabels is given more than once, samples must match every filter.
+func FilterLabels(key, expr string) func(*Profile) {
+	return func(p *Profile) {
+		p.labelFilters = append(p.labelFilters, &labelFilter{key: key, expr: expr})
+	}
+}
+
+// Deterministic rewrites the profile on Stop with its samples,
+// locations and functions in a stable, sorted order, and its
+// timestamps cleared, so that profiles of the same workload can be
+// compared byte for byte, for example in golden file tests.
+// Sampling itself remains nondeterministic.
+// Deterministic applies to the memory, mutex, block, thread creation
+// and goroutine profiles.
+func Deterministic(p *Profile) { p.deterministic = true }
+
+// Comment adds s to the comments of each profile written, for example
+// to note the circumstances in which it was captured. Comments are
+// shown by pprof -comments. Traces have no comments and are unchanged.
+func Comment(s string) func(*Profile) {
+	return func(p *Profile) {
+		p.comment = s
+	}
+}
+
+// Meta attaches the key value pairs of kv, such as the datacenter or
+// experiment of the run, to the session. They are written to meta.json
+// in the output directory at Start, and added to the comments of each
+// profile written as key=value. Pairs given by several calls are merged.
+func Meta(kv map[string]string) func(*Profile) {
+	return func(p *Profile) {
+		if p.meta == nil {
+			p.meta = make(map[string]string)
+		}
+		for k, v := range kv {
+			p.meta[k] = v
+		}
+	}
+}
+
+// writeMeta writes the Meta pairs to meta.json.
+func (p *Profile) writeMeta() {
+	data, err := json.MarshalIndent(p.meta, "", "\t")
+	if err != nil {
+		p.warnf("profile: could not encode metadata: %v", err)
+		return
+	}
+	fn := p.filename("meta.json")
+	if err := writeFile(p.fs, fn, append(data, '\n')); err != nil {
+		p.warnf("profile: could not write metadata %q: %v", fn, err)
+		return
+	}
+	p.logf("profile: metadata written to %s", fn)
+}
+
+// AffinityNote adds the cpus the process may run on at Start, such as
+// "cpu affinity: 0-3,8", to the comments of each profile written, to
+// tell apart profiles taken with different cpu pinning. It is only
+// supported on Linux, and does nothing elsewhere.
+func AffinityNote(p *Profile) { p.affinityNote = true }
+
+// comments returns the comments added to each pprof profile.
+func (p *Profile) comments() []string {
+	var comments []string
+	if p.comment != "" {
+		comments = append(comments, p.comment)
+	}
+	if p.correlationID != "" {
+		comments = append(comments, "correlation id: "+p.correlationID)
+	}
+	if p.affinity != "" {
+		comments = append(comments, "cpu affinity: "+p.affinity)
+	}
+	keys := make([]string, 0, len(p.meta))
+	for k := range p.meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		comments = append(comments, k+"="+p.meta[k])
+	}
+	return comments
+}
+
+// WriteInvocation writes the command line of the program, and the
+// environment variables named by env, to invocation.txt in the output
+// directory at Start, so that the circumstances of a profile can be
+// reproduced. A name ending in * matches any variable with that prefix,
+// for example "GO*". Only the variables named are written, to avoid
+// recording credentials.
+func WriteInvocation(env ...string) func(*Profile) {
+	return func(p *Profile) {
+		p.invocation = true
+		p.invocationEnv = append(p.invocationEnv, env...)
+	}
+}
+
+// writeInvocation writes invocation.txt.
+func (p *Profile) writeInvocation() {
+	var buf bytes.Buffer
+	buf.WriteString("args:\n")
+	for _, arg := range os.Args {
+		fmt.Fprintf(&buf, "\t%s\n", strconv.Quote(arg))
+	}
+	buf.WriteString("env:\n")
+	vars := os.Environ()
+	sort.Strings(vars)
+	for _, kv := range vars {
+		if key := strings.SplitN(kv, "=", 2)[0]; p.allowEnv(key) {
+			fmt.Fprintf(&buf, "\t%s\n", kv)
+		}
+	}
+	fn := p.filename("invocation.txt")
+	if err := writeFile(p.fs, fn, buf.Bytes()); err != nil {
+		p.warnf("profile: could not write invocation %q: %v", fn, err)
+		return
+	}
+	p.logf("profile: invocation written to %s", fn)
+}
+
+// allowEnv reports whether the environment variable key was
+// named by WriteInvocation.
+func (p *Profile) allowEnv(key string) bool {
+	for _, name := range p.invocationEnv {
+		if prefix := strings.TrimSuffix(name, "*"); prefix != name {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if key == name {
+			return true
+		}
+	}
+	return false
+}
+
+// WebUI opens each profile written in a browser on Stop, by running
+// go tool pprof -http, or go tool trace for traces, in the background.
+// The tools log the address they serve on. WebUI is intended for local
+// development only, and does nothing if the go command is not on PATH.
+// The tools keep running after the program exits.
+func WebUI(p *Profile) { p.webUI = true }
+
+// reportTop is the number of functions listed in each section of
+// the text report.
+const reportTop = 20
+
+// TextReport writes a report.txt file alongside the profiles on Stop,
+// listing the top functions of each pprof profile by flat and by
+// cumulative value. The report is useful on hosts without the pprof
+// tool. Profiles without symbol information are skipped.
+func TextReport(p *Profile) { p.textReport = true }
+
+// OmitEmpty removes the memory, mutex, block, thread creation and
+// goroutine profiles which hold no samples on Stop, for example a block
+// profile of a run which never blocked, logging that they were empty.
+// Files supplied by File are kept.
+func OmitEmpty(p *Profile) { p.omitEmpty = true }
+
+// removeEmpty removes the lookup profiles without samples.
+func (p *Profile) removeEmpty() {
+	files := p.files[:0]
+	for _, out := range p.files {
+		if p.lookup(out.mode) == "" || out.user || !p.empty(out.name) {
+			files = append(files, out)
+			continue
+		}
+		if err := p.fs.Remove(out.name); err != nil {
+			p.warnf("profile: could not remove empty profile %q: %v", out.name, err)
+			files = append(files, out)
+			continue
+		}
+		p.logf("profile: %s has no samples, removed", out.name)
+	}
+	p.files = files
+}
+
+// empty reports whether the pprof profile fn holds no samples.
+func (p *Profile) empty(fn string) bool {
+	data, err := readFile(p.fs, fn)
+	if err != nil {
+		return false
+	}
+	prof, err := pprofile.ParseData(data)
+	return err == nil && len(prof.Sample) == 0
+}
+
+// Verify reads back each profile written on Stop, after any
+// compression, and logs a warning if it cannot be parsed, to catch
+// truncated or corrupt files before they are archived. Execution
+// traces are only checked to start with a trace header.
+func Verify(p *Profile) { p.verify = true }
+
+// traceHeader starts every execution trace, followed by the
+// Go version which wrote it.
+var traceHeader = []byte("go 1.")
+
+// verifyFile returns an error if the file written by mode
+// cannot be parsed.
+func (p *Profile) verifyFile(fn string, mode int) error {
+	data, err := readFile(p.fs, fn)
+	if err != nil {
+		return err
+	}
+	if isTrace(mode) && strings.HasSuffix(fn, ".gz") {
+		if data, err = gunzip(data); err != nil {
+			return err
+		}
+	} else if isTrace(mode) && p.compressExt != "" && strings.HasSuffix(fn, p.compressExt) {
+		// there is no reader for the Compressor's format.
+		return nil
+	}
+	if isTrace(mode) {
+		if !bytes.HasPrefix(data, traceHeader) {
+			return errors.New("missing trace header")
+		}
+		return nil
+	}
+	_, err = pprofile.ParseData(data)
+	return err
+}
+
+// LatestSymlink makes a symbolic link in the output directory on Stop,
+// named after each mode, e.g. cpu-latest.pprof, to the newest file
+// the session wrote for that mode, so tools can always open the most
+// recent profile by a fixed name. Where symbolic links cannot be made,
+// the names of the newest files, one per mode, are written to
+// latest.txt instead.
+func LatestSymlink(p *Profile) { p.latestSymlink = true }
+
+// linkLatest links the newest file of each mode, or lists them
+// in latest.txt.
+func (p *Profile) linkLatest() {
+	var modes []int
+	newest := make(map[int]*output)
+	for _, out := range p.files {
+		if _, ok := newest[out.mode]; !ok {
+			modes = append(modes, out.mode)
+		} else if p.lookup(out.mode) != "" {
+			// lookup profiles are written on Stop, and so
+			// their first file is the newest.
+			continue
+		}
+		newest[out.mode] = out
+	}
+
+	_, native := p.fs.(osFS)
+	var list bytes.Buffer
+	for _, mode := range modes {
+		out := newest[mode]
+		ext := fileExt(out.name)
+		link := filepath.Join(p.path, modeName(mode)+"-latest"+ext)
+		target, err := filepath.Rel(p.path, out.name)
+		if err != nil {
+			target = out.name
+		}
+		if native {
+			os.Remove(link)
+			if err = os.Symlink(target, link); err == nil {
+				p.logf("profile: linked %s to %s", link, target)
+				continue
+			}
+		}
+		fmt.Fprintln(&list, out.name)
+	}
+	if list.Len() == 0 {
+		return
+	}
+	fn := filepath.Join(p.path, "latest.txt")
+	if err := writeFile(p.fs, fn, list.Bytes()); err != nil {
+		p.warnf("profile: could not write %q: %v", fn, err)
+		return
+	}
+	p.logf("profile: newest profiles listed in %s", fn)
+}
+
+// Flamegraph writes flame.svg to the output directory on Stop, a flame
+// graph of the cpu profile, or of the memory profile if no cpu profile
+// was taken. The svg is self contained and opens in any browser, for
+// sharing a profile with those without the pprof tool. It is best
+// effort, if the profile cannot be drawn a warning is logged.
+func Flamegraph(p *Profile) { p.flamegraph = true }
+
+// FoldedStacks writes the samples of each cpu and memory profile on
+// Stop in the folded stack format, e.g. cpu.folded alongside cpu.pprof,
+// for use with flamegraph.pl and other tools of the perf ecosystem.
+// Each line lists the functions of a stack, outermost first, separated
+// by semicolons, followed by its total.
+func FoldedStacks(p *Profile) { p.foldedStacks = true }
+
+// writeFolded writes the profile stored in fn in the folded stack
+// format.
+func (p *Profile) writeFolded(fn string) {
+	name := strings.TrimSuffix(fn, filepath.Ext(fn)) + ".folded"
+	data, err := readFile(p.fs, fn)
+	if err == nil {
+		var prof *pprofile.Profile
+		if prof, err = pprofile.ParseData(data); err == nil {
+			var buf bytes.Buffer
+			if err = foldedStacks(&buf, prof); err == nil {
+				err = writeFile(p.fs, name, buf.Bytes())
+			}
+		}
+	}
+	if err != nil {
+		p.warnf("profile: could not write folded stacks of %q: %v", fn, err)
+		return
+	}
+	p.logf("profile: folded stacks written to %s", name)
+}
+
+// writeFlamegraph draws the first cpu profile written, or else the
+// first memory profile, to flame.svg.
+func (p *Profile) writeFlamegraph() {
+	var src *output
+	for _, out := range p.files {
+		if out.mode == cpuMode {
+			src = out
+			break
+		}
+		if out.mode == memMode && src == nil {
+			src = out
+		}
+	}
+	if src == nil {
+		p.warnf("profile: no cpu or memory profile to draw a flame graph of")
+		return
+	}
+	fn := p.filename("flame.svg")
+	data, err := readFile(p.fs, src.name)
+	if err == nil {
+		var prof *pprofile.Profile
+		if prof, err = pprofile.ParseData(data); err == nil {
+			var buf bytes.Buffer
+			if err = flamegraph(&buf, prof); err == nil {
+				err = writeFile(p.fs, fn, buf.Bytes())
+			}
+		}
+	}
+	if err != nil {
+		p.warnf("profile: could not draw flame graph of %q: %v", src.name, err)
+		return
+	}
+	p.logf("profile: flame graph written to %s", fn)
+}
+
+// IndexHTML writes an index.html page to the output directory on Stop,
+// listing each file written with the go tool pprof or go tool trace
+// command which opens it, as a landing page for a bundle of profiles
+// shared with others. The page is static and needs no server.
+func IndexHTML(p *Profile) { p.indexHTML = true }
+
+// memViews are the sample types reported by MemBothViews.
+var memViews = []string{"inuse_space", "alloc_space"}
+
+// MemBothViews writes two text reports alongside each memory profile
+// on Stop, in the format of TextReport, of the space in use and of
+// the space allocated, e.g. mem-inuse_space.txt and mem-alloc_space.txt.
+// The profile itself records both, the reports save running the pprof
+// tool once for each view.
+func MemBothViews(p *Profile) { p.memViews = true }
+
+// Flush writes the current profiling data to disk without stopping
+// the session.
+// For the memory, mutex, block, thread creation and goroutine profiles
+// a snapshot is written to a new numbered file, e.g. mem.1.pprof.
+// The cpu profile, trace and clock profile are streamed to disk, they
+// cannot be flushed mid stream, so Flush rotates them: the current
+// file is completed and profiling continues into a new numbered file.
+func (p *Profile) Flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if atomic.LoadUint32(&p.stopped) != 0 || p.flush == nil {
+		return
+	}
+	p.flush()
+	p.prune()
+}
+
+// Rotation bounds the disk used by long running sessions, in the
+// manner of log rotation. Each limit is ignored if zero.
+//
+// Once a streamed cpu profile, trace or clock profile grows past
+// maxSizeMB megabytes the session is flushed, see Flush, so that
+// profiling continues into new numbered files.
+//
+// After each Flush, and at Start and Stop, the profile files in the
+// output directory are pruned. Only the newest maxBackups files of
+// each profile are kept besides the latest, where the numbered files
+// written by Flush and the timestamped files written by Continuous
+// are those of the profile they were named after, and files older
+// than maxAgeDays days are removed, including those of earlier runs.
+// Pruning needs the operating system's file system, see FS.
+func Rotation(maxSizeMB, maxBackups, maxAgeDays int) func(*Profile) {
+	return func(p *Profile) {
+		p.rotateSize = int64(maxSizeMB) << 20
+		p.rotateBackups = maxBackups
+		p.rotateAge = time.Duration(maxAgeDays) * 24 * time.Hour
+	}
+}
+
+// rotateWriter flushes the session once rotateSize bytes have
+// been written to w.
+type rotateWriter struct {
+	w       io.Writer
+	p       *Profile
+	written int64
+}
+
+func (r *rotateWriter) Write(buf []byte) (int, error) {
+	n, err := r.w.Write(buf)
+	total := atomic.AddInt64(&r.written, int64(n))
+	if over := total - int64(n); over < r.p.rotateSize && total >= r.p.rotateSize {
+		r.p.logf("profile: %d bytes written, rotating", total)
+		// Flush waits for the profile writer, which is
+		// calling Write, so it must run on another goroutine.
+		go r.p.Flush()
+	}
+	return n, err
+}
+
+// rotated matches the numbers and timestamps which distinguish the
+// files written by Flush and Continuous from their profile's name.
+var rotated = regexp.MustCompile(`(\.[0-9]+)+\.|-[0-9]{8}T[0-9]{6}\.[0-9]{3}Z\.`)
+
+// profileExts are the extensions of the files pruned by Rotation.
+var profileExts = []string{".pprof", ".out", ".trace"}
+
+// compressedExts are the extensions of compressed profile files.
+var compressedExts = []string{".gz", ".zst"}
+
+// trimCompressed returns name without its compressed extension.
+func trimCompressed(name string) string {
+	for _, ext := range compressedExts {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return name
+}
+
+// fileExt returns the extension of name, including that of the
+// profile beneath a compressed extension, e.g. .out.gz.
+func fileExt(name string) string {
+	ext := filepath.Ext(name)
+	if trimmed := trimCompressed(name); trimmed != name {
+		ext = filepath.Ext(trimmed) + ext
+	}
+	return ext
+}
+
+// prunePoll is the interval at which the output directory is pruned
+// to the limits set by MaxFiles and MaxAge while the session runs.
+const prunePoll = time.Minute
+
+// MaxFiles bounds the disk used by programs which write repeatedly into
+// one ProfilePath, for example with Continuous, by keeping only the
+// newest n profile files in the output directory, including those of
+// earlier runs. The directory is pruned at Start and Stop, after each
+// Flush and every minute while the session runs. Files still being
+// written are never removed. Pruning needs the operating system's file
+// system, see FS. MaxFiles may be combined with MaxAge and Rotation,
+// files being removed once beyond any of their limits.
+func MaxFiles(n int) func(*Profile) {
+	return func(p *Profile) { p.maxFiles = n }
+}
+
+// MaxAge removes the profile files in the output directory older than
+// d, including those of earlier runs, in the same way as MaxFiles.
+func MaxAge(d time.Duration) func(*Profile) {
+	return func(p *Profile) { p.maxAge = d }
+}
+
+// retain prunes the output directory every prunePoll until the
+// session stops.
+func (p *Profile) retain() {
+	t := time.NewTicker(prunePoll)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-t.C:
+			p.mu.Lock()
+			if atomic.LoadUint32(&p.stopped) == 0 {
+				p.prune()
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// prune removes the files of the output directory beyond the limits
+// set by Rotation, MaxFiles and MaxAge.
+func (p *Profile) prune() {
+	if _, ok := p.fs.(osFS); !ok || (p.rotateBackups <= 0 && p.rotateAge <= 0 && p.maxFiles <= 0 && p.maxAge <= 0) {
+		return
+	}
+	files, err := profiles(p.path)
+	if err != nil {
+		p.warnf("profile: could not prune %q: %v", p.path, err)
+		return
+	}
+	groups := make(map[string][]os.FileInfo)
+	var keys []string
+	for _, e := range files {
+		key := rotated.ReplaceAllString(trimCompressed(e.Name()), ".")
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], e)
+	}
+	now := time.Now()
+	var kept []os.FileInfo
+	for _, key := range keys {
+		files := groups[key]
+		sort.SliceStable(files, func(i, j int) bool {
+			return files[i].ModTime().After(files[j].ModTime())
+		})
+		for i, e := range files {
+			old := p.rotateAge > 0 && now.Sub(e.ModTime()) > p.rotateAge
+			surplus := p.rotateBackups > 0 && i > p.rotateBackups
+			if !old && !surplus || !p.remove(e.Name()) {
+				kept = append(kept, e)
+			}
+		}
+	}
+	sort.SliceStable(kept, func(i, j int) bool {
+		return kept[i].ModTime().After(kept[j].ModTime())
+	})
+	n := 0
+	for _, e := range kept {
+		if p.writing(filepath.Join(p.path, e.Name())) {
+			n++
+			continue
+		}
+		old := p.maxAge > 0 && now.Sub(e.ModTime()) > p.maxAge
+		surplus := p.maxFiles > 0 && n >= p.maxFiles
+		if !old && !surplus || !p.remove(e.Name()) {
+			n++
+		}
+	}
+}
+
+// remove removes the named file of the output directory, reporting
+// whether it was removed.
+func (p *Profile) remove(name string) bool {
+	fn := filepath.Join(p.path, name)
+	if err := p.fs.Remove(fn); err != nil {
+		p.warnf("profile: could not remove %q: %v", fn, err)
+		return false
+	}
+	p.forget(fn)
+	p.logf("profile: removed %s", fn)
+	return true
+}
+
+// writing reports whether fn is a file the session is writing.
+func (p *Profile) writing(fn string) bool {
+	for _, out := range p.files {
+		if out.name == fn && out.open {
+			return true
+		}
+	}
+	return false
+}
+
+// forget drops fn from the files written by the session.
+func (p *Profile) forget(fn string) {
+	for i, out := range p.files {
+		if out.name == fn {
+			p.files = append(p.files[:i], p.files[i+1:]...)
+			return
+		}
+	}
+}
+
+// MaxBytes stops profiling automatically, logging a warning, once n
+// bytes of profiling data have been written. It protects shared
+// machines from runaway traces filling the disk.
+// MaxBytes applies to the streamed cpu profile, trace and clock profile,
+// across all of their rotated files. Data flushed while stopping may
+// exceed the limit slightly.
+func MaxBytes(n int64) func(*Profile) {
+	return func(p *Profile) {
+		p.maxBytes = n
+	}
+}
+
+// Preallocate reserves n bytes of disk space for each profile file
+// when it is created, reducing fragmentation and write stalls for
+// large traces. Unused space is released when the file is closed.
+// Preallocate is only supported on Linux, elsewhere it has no effect.
+func Preallocate(n int64) func(*Profile) {
+	return func(p *Profile) {
+		p.preallocate = n
+	}
+}
+
+// MergeOnStop merges the files written by a cpu or clock profile
+// which has been rotated by Flush, e.g. cpu.pprof, cpu.1.pprof, ...,
+// into a single profile on Stop.
+// The merged profile replaces the first file and the remaining
+// files are removed.
+func MergeOnStop(p *Profile) { p.mergeOnStop = true }
+
+// ResetOnFlush makes each Flush of a block or mutex profile write
+// the contention recorded since the previous Flush, or since profiling
+// started, rather than the cumulative total. This makes interval based
+// contention monitoring possible. The profile written on Stop remains
+// cumulative.
+func ResetOnFlush(p *Profile) { p.resetOnFlush = true }
+
+// RecordDuration sets the duration of each heap, allocs, block and
+// mutex profile written to the time since profiling started, so that
+// the rates shown by the pprof tool, e.g. contentions per second, are
+// those of the session. The runtime records only the time taken to
+// write the profile.
+func RecordDuration(p *Profile) { p.recordDuration = true }
+
+// timed are the runtime/pprof profiles whose duration is recorded
+// by RecordDuration.
+var timed = map[string]bool{"heap": true, "allocs": true, "block": true, "mutex": true}
+
+// RingBuffer keeps the most recent n snapshots taken by Flush of the
+// memory, mutex, block, thread creation and goroutine profiles in
+// memory, and writes them as numbered files only on Stop, including
+// Stop by the shutdown hook. Calling Flush periodically keeps a rolling
+// window of the state leading up to an incident.
+func RingBuffer(n int) func(*Profile) {
+	return func(p *Profile) {
+		p.ringSize = n
+	}
+}
+
+// Continuous writes a heap and a goroutine profile every interval until
+// the session stops, for a lightweight record of a long running service.
+// The profiles are named by the time they were written, for example
+// heap-20060102T150405.000Z.pprof, and only the most recent keep of each
+// are kept; if keep is zero all are kept. Continuous runs alongside the
+// profiling mode of the session. ContinuousCPU also splits the cpu
+// profile into windows of interval.
+func Continuous(interval time.Duration, keep int) func(*Profile) {
+	return func(p *Profile) {
+		p.continuousInterval = interval
+		p.continuousKeep = keep
+	}
+}
+
+// ContinuousCPU splits the cpu profile of a session with Continuous
+// into one file per interval, named by the time its window began, for
+// example cpu-20060102T150405.000Z.pprof, so that a long running service
+// can be profiled continuously in fixed windows. Only the most recent
+// keep complete windows are kept, alongside the one being written.
+//
+//	profile.Start(profile.Continuous(30*time.Second, 10), profile.ContinuousCPU)
+func ContinuousCPU(p *Profile) { p.continuousCPU = true }
+
+// ProfileOnSignal replaces profiling on Start with profiling on demand:
+// each time the process receives sig a session of mode, for example
+// profile.CPUProfile, is started and stopped after d, writing its files
+// to a new signal-<time> directory in the output directory. The process
+// keeps running. Signals received while a capture runs are ignored.
+// Stop stops any capture in progress, writing its files, and removes
+// the handler.
+//
+//	profile.Start(profile.ProfileOnSignal(syscall.SIGUSR2, profile.CPUProfile, 30*time.Second))
+func ProfileOnSignal(sig os.Signal, mode func(*Profile), d time.Duration) func(*Profile) {
+	return func(p *Profile) {
+		p.signal = sig
+		p.signalMode = mode
+		p.signalDuration = d
+	}
+}
+
+// onSignal starts a capture each time sig is received, until Stop.
+func (p *Profile) onSignal(c chan os.Signal) {
+	defer p.captures.Done()
+	defer signal.Stop(c)
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-c:
+			if !atomic.CompareAndSwapUint32(&p.capturing, 0, 1) {
+				p.logf("profile: %v received, capture in progress, ignoring", p.signal)
+				continue
+			}
+			p.logf("profile: %v received, profiling for %v", p.signal, p.signalDuration)
+			p.captures.Add(1)
+			go p.captureOnSignal()
+		}
+	}
+}
+
+// captureOnSignal runs a session of signalMode for signalDuration,
+// or until Stop.
+func (p *Profile) captureOnSignal() {
+	defer p.captures.Done()
+	defer atomic.StoreUint32(&p.capturing, 0)
+	dir := filepath.Join(p.path, "signal-"+time.Now().UTC().Format(continuousFormat))
+	s, err := StartErr(p.signalMode, Isolated, ProfilePath(dir), FS(p.fs), Verbosity(p.verbosity), Reason("signal"), func(s *Profile) {
+		s.capture = true
+		s.correlationID = p.correlationID
+		s.nameTemplate = p.nameTemplate
+		s.hostPID = p.hostPID
+		s.dirMode, s.fileMode = p.dirMode, p.fileMode
+		s.atomic = p.atomic
+		s.logger = p.logger
+	})
+	if err != nil {
+		p.warnf("profile: could not start capture on %v: %v", p.signal, err)
+		return
+	}
+	t := time.NewTimer(p.signalDuration)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-p.done:
+	}
+	s.Stop()
+}
+
+// continuousFormat is the time format used in the names of the
+// profiles written by Continuous.
+const continuousFormat = "20060102T150405.000Z"
+
+// continuous writes snapshots every continuousInterval until
+// the session stops.
+func (p *Profile) continuous() {
+	t := time.NewTicker(p.continuousInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case now := <-t.C:
+			p.mu.Lock()
+			if atomic.LoadUint32(&p.stopped) != 0 {
+				p.mu.Unlock()
+				return
+			}
+			if p.rotateCPU != nil {
+				p.rotateWindow(now)
+			}
+			for _, name := range []string{"heap", "goroutine"} {
+				fn := p.filename(name + "-" + now.UTC().Format(continuousFormat) + ".pprof")
+				if err := p.writeContinuous(fn, name); err != nil {
+					p.warnf("profile: could not write %s profile %q: %v", name, fn, err)
+					continue
+				}
+				p.logf("profile: %s profile written, %s", name, fn)
+				p.pruneContinuous(name, fn)
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// rotateWindow closes the current cpu window, starting the next one
+// named after now. The caller must hold mu.
+func (p *Profile) rotateWindow(now time.Time) {
+	fn := p.filename("cpu-" + now.UTC().Format(continuousFormat) + ".pprof")
+	if old, ok := p.rotateCPU(fn); ok {
+		p.logf("profile: cpu profile written, %s", old)
+		p.pruneContinuous("cpu", old)
+	}
+}
+
+// pruneContinuous records fn as written for the named profile by
+// Continuous and removes those beyond the most recent continuousKeep.
+func (p *Profile) pruneContinuous(name, fn string) {
+	if p.continuousFiles == nil {
+		p.continuousFiles = make(map[string][]string)
+	}
+	written := p.continuousFiles
+	written[name] = append(written[name], fn)
+	keep := p.continuousKeep
+	if keep <= 0 || len(written[name]) <= keep {
+		return
+	}
+	for _, old := range written[name][:len(written[name])-keep] {
+		if err := p.fs.Remove(old); err != nil {
+			p.warnf("profile: could not remove %s profile %q: %v", name, old, err)
+		}
+		p.forget(old)
+	}
+	written[name] = append(written[name][:0], written[name][len(written[name])-keep:]...)
+}
+
+// writeContinuous writes the named runtime/pprof profile to fn.
+func (p *Profile) writeContinuous(fn, name string) error {
+	mode := goroutineMode
+	if name == "heap" {
+		mode = memMode
+	}
+	f, err := p.create(mode, fn)
+	if err != nil {
+		return err
+	}
+	if name == "heap" && p.gcBeforeSnapshot {
+		runtime.GC()
+	}
+	if err := p.writeLookup(f, name); err != nil {
+		p.discard(f)
+		return err
+	}
+	return p.close(f)
+}
+
+// AutoName prefixes the profile file names with the base name of the
+// running program, e.g. myservice-cpu.pprof, so profiles collected
+// from several programs into one directory are easy to tell apart.
+func AutoName(p *Profile) { p.autoName = true }
+
+// HostPID inserts the host name and process id before the extension
+// of each file name, e.g. cpu-myhost-1234.pprof, so that processes on
+// several machines writing to one shared directory do not overwrite
+// each other's profiles.
+func HostPID(p *Profile) {
+	p.hostPID = hostname() + "-" + strconv.Itoa(os.Getpid())
+}
+
+// hostname returns the name of the host, sanitised for use in a
+// file name, or unknown if it cannot be found.
+func hostname() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "unknown"
+	}
+	return sanitize(host)
+}
+
+// nameTimeFormat is the format of the time given to FilenameTemplate.
+const nameTimeFormat = "20060102T150405Z"
+
+// fileName holds the fields given to FilenameTemplate.
+type fileName struct {
+	Name string // the default name without its extension, e.g. cpu
+	Ext  string // the extension of the default name, e.g. .pprof
+	Time string // the time the session's files are named for, in UTC
+	Host string // the host name
+	PID  int    // the process id
+}
+
+// FilenameTemplate names the files written by the template tmpl, in
+// the syntax of text/template, e.g. "{{.Name}}-{{.Time}}-{{.PID}}{{.Ext}}"
+// names the cpu profile cpu-20060102T150405Z-1234.pprof, so that
+// successive runs do not overwrite each other's profiles. The fields
+// .Name and .Ext are those of the default name of each file, cpu and
+// .pprof; .Time is the time the session started, the same for all
+// files it writes; .Host and .PID are the host name and process id.
+// Prefixes such as those of AutoName and CorrelationID are added to
+// the names made.
+func FilenameTemplate(tmpl string) func(*Profile) {
+	return func(p *Profile) {
+		t, err := texttemplate.New("filename").Parse(tmpl)
+		if err == nil {
+			err = t.Execute(ioutil.Discard, fileName{Name: "cpu", Ext: ".pprof"})
+		}
+		if err != nil {
+			p.fail(fmt.Errorf("invalid filename template: %v", err))
+			return
+		}
+		p.nameTemplate = t
+	}
+}
+
+// Reason records why the session was started, such as "panic" or
+// "scheduled", in the name of each file written, before its extension,
+// e.g. cpu.panic.pprof. The reason is sanitised for use in a file name.
+// Sessions started by ProfileOnSignal are given the reason "signal".
+func Reason(s string) func(*Profile) {
+	return func(p *Profile) { p.reason = sanitize(s) }
+}
+
+// pressurePoll is the interval at which the heap is checked against
+// the limit set by DisableUnderPressure.
+const pressurePoll = time.Second
+
+// DisableUnderPressure guards against profiling adding to the memory
+// pressure of a process close to its limit. If the heap in use, as
+// reported by runtime.ReadMemStats, has reached heapLimitBytes, Start
+// logs a warning and returns a session which does nothing. The heap
+// is then checked every second, and the session stopped, writing the
+// profiles taken so far, once it reaches the limit.
+func DisableUnderPressure(heapLimitBytes uint64) func(*Profile) {
+	return func(p *Profile) { p.heapLimit = heapLimitBytes }
+}
+
+// heapAlloc returns the bytes of heap objects in use.
+func heapAlloc() uint64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
+
+// watchPressure stops the session once the heap reaches heapLimit.
+func (p *Profile) watchPressure() {
+	t := time.NewTicker(pressurePoll)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-t.C:
+			if heap := heapAlloc(); heap >= p.heapLimit {
+				p.warnf("profile: heap of %d bytes reached limit of %d bytes, stopping profiling", heap, p.heapLimit)
+				p.stop(false)
+				return
+			}
+		}
+	}
+}
+
+// Duration stops the session automatically, writing the profiles, d
+// after profiling begins, for example to profile the next 30 seconds
+// of a long running program without managing a timer. Stop may still be called
+// sooner, and waits for a session being stopped by Duration to finish.
+func Duration(d time.Duration) func(*Profile) {
+	return func(p *Profile) {
+		if d <= 0 {
+			p.fail(fmt.Errorf("invalid duration %v, must be positive", d))
+			return
+		}
+		p.duration = d
+	}
+}
+
+// Delay begins profiling d after Start, so that the warm up of the
+// program, such as loading its configuration and filling its caches,
+// does not dominate the profiles. As with MinGoroutines, Start returns
+// immediately and profiling begins in the background, and nothing is
+// written if the session is stopped before it begins. Delay may be
+// combined with MinGoroutines and StartAfter, profiling beginning once
+// every condition is met. As with MinGoroutines, a failure to begin
+// is logged and reported by StopErr rather than ending the program.
+func Delay(d time.Duration) func(*Profile) {
+	return func(p *Profile) {
+		if d < 0 {
+			p.fail(fmt.Errorf("invalid delay %v, must not be negative", d))
+			return
+		}
+		p.delay = d
+	}
+}
+
+// stopAfter stops the session once its duration has elapsed.
+func (p *Profile) stopAfter() {
+	t := time.NewTimer(p.duration)
+	defer t.Stop()
+	select {
+	case <-p.done:
+	case <-t.C:
+		p.logf("profile: duration of %v elapsed, stopping profiling", p.duration)
+		p.stop(false)
+	}
+}
+
+// CorrelationID groups the files written by the sessions of one logical
+// operation, such as an incident or a distributed job, by prefixing the
+// name of each file with id, e.g. job-42-cpu.pprof, and recording it in
+// the comments of each pprof profile as "correlation id: job-42". The
+// id is sanitised for use in a file name. It is also given to sessions
+// started by ProfileOnSignal.
+func CorrelationID(id string) func(*Profile) {
+	return func(p *Profile) { p.correlationID = id }
+}
+
+// Sync flushes each profile file to stable storage before it is
+// closed, so that profiles survive a crash or power loss shortly
+// after profiling stops, at the cost of an fsync per file.
+func Sync(p *Profile) { p.sync = true }
+
+// DefaultMinFreeSpace is the default amount of free disk space, in bytes,
+// required in the output directory for profiling to start.
+const DefaultMinFreeSpace = 1 << 20
+
+// MinFreeSpace sets the amount of free disk space, in bytes, required
+// in the output directory for profiling to start, rather than risk
+// writing truncated profiles. A value of zero disables the check.
+// Free space is checked on Linux, macOS and FreeBSD.
+func MinFreeSpace(bytes uint64) func(*Profile) {
+	return func(p *Profile) {
+		p.minFreeSpace = bytes
+	}
+}
+
+// FS sets the file system profiles are written to, in place of the
+// file system of the operating system. Preallocate and Sync have no
+// effect unless the files created are *os.File values, and free disk
+// space is only checked on the operating system's file system.
+func FS(fsys FileSystem) func(*Profile) {
+	return func(p *Profile) {
+		p.fs = fsys
+	}
+}
+
+// DefaultDirAttempts is the default number of attempts made to create
+// the output directory.
+const DefaultDirAttempts = 3
+
+// DirAttempts sets the number of attempts made to create the output
+// directory before profiling fails to start. Attempts are retried with
+// exponential backoff, and only if the failure may be transient, for
+// example because the disk is momentarily full.
+func DirAttempts(n int) func(*Profile) {
+	return func(p *Profile) {
+		p.dirAttempts = n
+	}
+}
+
+// dirBackoff is the delay before the first retry of output
+// directory creation. It doubles with each attempt.
+const dirBackoff = 10 * time.Millisecond
+
+// retry calls fn up to attempts times, waiting delay, doubled each time,
+// between attempts while fn fails with a transient error. Retries are
+// reported to warnf.
+func retry(attempts int, delay time.Duration, warnf func(string, ...interface{}), fn func() error) error {
+	for i := 1; ; i++ {
+		err := fn()
+		if err == nil || i >= attempts || !transient(err) {
+			return err
+		}
+		warnf("profile: attempt %d of %d failed, retrying in %v: %v", i, attempts, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// transient reports whether err may succeed if retried.
+func transient(err error) bool {
+	if err == io.ErrShortWrite {
+		return true
+	}
+	for _, errno := range []syscall.Errno{syscall.EAGAIN, syscall.EINTR, syscall.EBUSY, syscall.ENOSPC} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// TarWriter writes the files of the session, the profile of each
+// mode and any reports, to w as a single tar stream on Stop, rather
+// than to the output directory. Nothing is written to disk, the
+// files are held in memory until Stop. Entries are named relative
+// to the output directory. TarWriter replaces the file system set
+// by FS, and does not close w.
+func TarWriter(w io.Writer) func(*Profile) {
+	return func(p *Profile) { p.tar = w }
+}
+
+// writeTar writes the files held in memory to the tar stream.
+func (p *Profile) writeTar() error {
+	fsys, ok := p.fs.(*bufferFS)
+	if !ok {
+		return nil
+	}
+	tw := tar.NewWriter(p.tar)
+	err := fsys.each(func(name string, data []byte) error {
+		rel, err := filepath.Rel(p.path, name)
+		if err != nil {
+			rel = filepath.Base(name)
+		}
+		hdr := &tar.Header{
+			Name:    filepath.ToSlash(rel),
+			Mode:    int64(p.filePerm()),
+			Size:    int64(len(data)),
+			ModTime: p.end,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// JSONLog writes the start and stop of profiling to w as JSON objects,
+// one per line, in place of the informational log messages. Each object
+// holds the event, "start" or "stop", the profiling mode, the path of
+// the profile, a timestamp, and for memory profiles the sampling rate.
+// Stop events also hold the duration of profiling in nanoseconds and the
+// bytes written. Quiet suppresses the events.
+func JSONLog(w io.Writer) func(*Profile) {
+	return func(p *Profile) {
+		p.jsonLog = w
+	}
+}
+
+// Tee writes the cpu profile to each of writers as well as to the
+// profile file, for example to stream it to a collector while keeping
+// a local copy. A destination which fails to write is reported and
+// dropped without affecting the others. Destinations are flushed or
+// closed, if they support it, when profiling stops.
+func Tee(writers ...io.Writer) func(*Profile) {
+	return func(p *Profile) {
+		p.tee = append(p.tee, writers...)
+	}
+}
+
+// File writes the profile of the profiling mode, as set by options
+// such as CPUProfile, to f rather than to a file in the output
+// directory, which is not created unless other modes are added by
+// Also. The caller owns f: it is not closed on Stop.
+// Files written by Flush are placed alongside f.
+func File(f *os.File) func(*Profile) {
+	return func(p *Profile) {
+		p.file = f
+	}
+}
+
+// WriteTo writes the profile of mode, as set by options such as
+// MemProfile, to w rather than to a file in the output directory, for
+// example to a buffer, a pipe or a network connection. It does not
+// enable mode. If every mode of the session is written to a writer,
+// and ProfilePath is not set, no output directory is created, for
+// programs on read only file systems. Messages name the profile as
+// if it were in the output directory. The profile is not post
+// processed, by Compress or Verify for example, and does not appear
+// in Results. Files written by Flush are placed in the output
+// directory. WriteTo does not close w.
+func WriteTo(mode func(*Profile), w io.Writer) func(*Profile) {
+	return func(p *Profile) {
+		primary := p.mode
+		mode(p)
+		if p.streams == nil {
+			p.streams = make(map[int]io.Writer)
+		}
+		p.streams[p.mode] = w
+		p.mode = primary
+	}
+}
+
+// ProfileName names the file the profile of mode, as set by options
+// such as CPUProfile, is written to, e.g. api-cpu.pprof rather than
+// cpu.pprof. It does not enable mode. The name is placed in the output
+// directory, and files derived from it, such as those of Flush and
+// FoldedStacks, are named after it, e.g. api-cpu.1.pprof.
+func ProfileName(mode func(*Profile), name string) func(*Profile) {
+	return func(p *Profile) {
+		if name == "" || filepath.Base(name) != name {
+			p.fail(fmt.Errorf("invalid profile name %q, must be a file name", name))
+			return
+		}
+		primary := p.mode
+		mode(p)
+		if p.names == nil {
+			p.names = make(map[int]string)
+		}
+		p.names[p.mode] = name
+		p.mode = primary
+	}
+}
+
+// baseName returns the name of the file mode writes, name unless
+// ProfileName gave another.
+func (p *Profile) baseName(mode int, name string) string {
+	if n, ok := p.names[mode]; ok {
+		return n
+	}
+	return name
+}
+
+// streamed reports whether the profile of every mode of the session
+// is written to a writer set by WriteTo.
+func (p *Profile) streamed() bool {
+	for _, mode := range p.modes() {
+		if p.streams[mode] == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// nopCloser is a writer set by WriteTo, which the session does not
+// close.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// Isolated allows the session to run alongside other profiling
+// sessions, for example one per HTTP request in server middleware.
+// An isolated session does not install a shutdown hook, and should
+// be given its own ProfilePath or AutoName so that concurrent
+// sessions do not overwrite each other's files.
+//
+// Profiling is costly: isolated sessions are intended for debugging
+// specific requests or endpoints, not for every request. The cpu
+// profiler and the tracer are process wide and only one of each can
+// run at a time; an isolated session which cannot start them logs the
+// failure and continues without them. Samples from every goroutine are
+// recorded, use Labels and FilterLabels to keep those of the session.
+// Settings such as the memory profiling rate are shared by all sessions.
+func Isolated(p *Profile) { p.isolated = true }
+
+// Lazy makes Start only configure the session: nothing is installed,
+// no directory is created and the check that no other session is
+// running is left until the Begin, or BeginErr, method of the value
+// returned is called. Stop before Begin does nothing. This lets a host
+// configure a session which code elsewhere starts when needed.
+func Lazy(p *Profile) { p.lazy = true }
+
+// Labels applies the pprof labels given as key value pairs to the
+// goroutine calling Start, and to the goroutines it starts, until Stop.
+// Stop must be called on the same goroutine, and clears its labels.
+// Labels are recorded by the cpu and goroutine profiles and, with
+// FilterLabels, let a session keep only the samples of its own work.
+func Labels(args ...string) func(*Profile) {
+	return func(p *Profile) {
+		if len(args)%2 != 0 {
+			p.fail(fmt.Errorf("Labels requires key value pairs, got %d arguments", len(args)))
+			return
+		}
+		p.labels = append(p.labels, args...)
+	}
+}
+
+// LabelsFromContext applies the labels of ctx, as set by pprof.Do or
+// pprof.WithLabels, to the goroutine calling Start, as Labels does,
+// along with a label for each of keys whose value is found in ctx.
+// Values are found by the function given to LabelExtractor, for
+// example to label samples with the ID of the current trace span.
+func LabelsFromContext(ctx context.Context, keys ...string) func(*Profile) {
+	return func(p *Profile) {
+		p.labelCtx = ctx
+		p.labelKeys = append(p.labelKeys, keys...)
+	}
+}
+
+// LabelExtractor sets the function used by LabelsFromContext to find
+// the value of key in ctx. The default extractor returns ctx.Value(key)
+// if it is a string or a fmt.Stringer.
+func LabelExtractor(extract func(ctx context.Context, key string) (string, bool)) func(*Profile) {
+	return func(p *Profile) {
+		p.extractLabel = extract
+	}
+}
+
+// valueLabel is the default label extractor.
+func valueLabel(ctx context.Context, key string) (string, bool) {
+	switch v := ctx.Value(key).(type) {
+	case string:
+		return v, true
+	case fmt.Stringer:
+		return v.String(), true
+	}
+	return "", false
+}
+
+// MinGoroutines delays profiling until at least n goroutines are
+// running, for example until a worker pool is busy, so that idle
+// time is not profiled. Start returns immediately and profiling
+// begins in the background. If timeout is non zero and n goroutines
+// are not running by then, profiling begins anyway with a warning.
+// Nothing is written if the session is stopped before it begins. If
+// profiling cannot begin, for example as a profile cannot be created,
+// a warning is logged and StopErr reports it; the program carries on.
+func MinGoroutines(n int, timeout time.Duration) func(*Profile) {
+	return func(p *Profile) {
+		p.minGoroutines = n
+		p.minGoroutinesTimeout = timeout
+	}
+}
+
+// OnStart calls fn with the path of the output directory once it has
+// been created, before profiling begins, for example to record where
+// the profiles will be written. Functions are called in the order
+// given, on the goroutine calling Start.
+func OnStart(fn func(path string)) func(*Profile) {
+	return func(p *Profile) { p.onStart = append(p.onStart, fn) }
+}
+
+// OnStop calls fn with the names of the profile files written, as
+// Files returns them, once the session has stopped and every file
+// has been written and closed, for example to upload the profiles.
+// Functions are called in the order given, on the goroutine which
+// stopped the session. They are not called for a session which did
+// not profile, one whose When condition was not met for example.
+func OnStop(fn func(files []string)) func(*Profile) {
+	return func(p *Profile) { p.onStop = append(p.onStop, fn) }
+}
+
+// BeforeStart calls fn with the time Start was called as the session
+// starts, once its conditions, such as When, have been met and before
+// the output directory is created, for example to count sessions or
+// write an audit log. Functions are called in the order given, on the
+// goroutine which starts profiling.
+func BeforeStart(fn func(start time.Time)) func(*Profile) {
+	return func(p *Profile) { p.beforeStart = append(p.beforeStart, fn) }
+}
+
+// AfterStop calls fn with the Results of the session once it has
+// stopped, after the functions given to OnStop, for example to record
+// how long profiling ran and, with OverheadStats, what it cost. It is
+// called only for sessions for which BeforeStart functions were called
+// and which started without error.
+func AfterStop(fn func(r Results)) func(*Profile) {
+	return func(p *Profile) { p.afterStop = append(p.afterStop, fn) }
+}
+
+// StartAfter delays profiling until the counter, which the program
+// increments atomically, for example once per request, reaches
+// threshold, so that profiling begins after a given amount of work
+// rather than of time. As with MinGoroutines, Start returns
+// immediately and profiling begins in the background, and nothing
+// is written if the session is stopped before it begins.
+func StartAfter(counter *int64, threshold int64) func(*Profile) {
+	return func(p *Profile) {
+		p.startAfter = counter
+		p.startAfterThreshold = threshold
+	}
+}
+
+// counted reports whether the StartAfter counter has reached
+// its threshold.
+func (p *Profile) counted() bool {
+	return p.startAfter == nil || atomic.LoadInt64(p.startAfter) >= p.startAfterThreshold
+}
+
+// When makes profiling conditional on cond, which is evaluated when
+// Start is called. If cond returns false the session does nothing:
+// no files are created, no hooks are installed, and Stop and Flush
+// have no effect. For example, to only profile a process whose heap
+// has grown unexpectedly large:
+//
+//	profile.Start(profile.MemProfile, profile.When(func() bool {
+//		var m runtime.MemStats
+//		runtime.ReadMemStats(&m)
+//		return m.HeapAlloc > 1<<30
+//	}))
+func When(cond func() bool) func(*Profile) {
+	return func(p *Profile) {
+		p.when = cond
+	}
+}
+
+// StrictStop makes a second call to Stop panic, rather than do nothing,
+// to catch mistakes in the management of the profiling session.
+// Sessions stopped by the shutdown hook or by MaxBytes may still
+// be stopped once more by the caller.
+func StrictStop(p *Profile) { p.strictStop = true }
+
+// Stop stops the profile and flushes any unwritten data.
+// Stop may be called from any goroutine, and returns once every
+// profile has been written and closed. A call made while the
+// session is being stopped waits for it to finish.
+func (p *Profile) Stop() { p.stop(p.strictStop) }
+
+// StopAndWait stops the profile as Stop does, then flushes each
+// profile file written, and the output directory, to stable storage,
+// so that a coordinator may ship the profiles once it returns.
+// It returns the first error encountered.
+func (p *Profile) StopAndWait() error {
+	p.Stop()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.fs.(osFS); !ok || len(p.files) == 0 {
+		return nil
+	}
+	var err error
+	for _, out := range p.files {
+		if serr := syncFile(out.name); serr != nil && err == nil {
+			err = fmt.Errorf("profile: could not sync %q: %v", out.name, serr)
+		}
+	}
+	if runtime.GOOS != "windows" {
+		// directories cannot be synced on windows.
+		if serr := syncFile(p.path); serr != nil && err == nil {
+			err = fmt.Errorf("profile: could not sync %q: %v", p.path, serr)
+		}
+	}
+	return err
+}
+
+// StopErr stops the profile as Stop does, and returns the names of
+// the profile files written and the first problem met writing them,
+// such as a profile which could not be written in full or a file which
+// could not be closed, which Stop only logs. Files set aside as
+// incomplete are not listed.
+func (p *Profile) StopErr() ([]string, error) {
+	p.Stop()
+	files := p.Files()
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	return files, p.stopErr
+}
+
+// Path returns the output directory of the session, such as the one
+// Start creates in the default directory for temporary files when
+// ProfilePath is not set.
+func (p *Profile) Path() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.path
+}
+
+// Files returns the names of the profile files the session has
+// written, or is writing, so far, in the order they were created.
+// After Stop they are the names of the files as finally written, for
+// instance once compressed. Files written to writers set by WriteTo
+// are not listed.
+func (p *Profile) Files() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var files []string
+	for _, out := range p.files {
+		files = append(files, out.name)
+	}
+	return files
+}
+
+// syncFile flushes the named file to stable storage.
+func syncFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// stop stops the profile, panicking if strict and the
+// profile has already been stopped by the caller.
+func (p *Profile) stop(strict bool) {
+	if !atomic.CompareAndSwapUint32(&p.stopped, 0, 1) {
+		// someone has already called close
+		if strict && atomic.SwapUint32(&p.stopCalls, 1) != 0 {
+			panic("profile: Stop called more than once")
+		}
+		<-p.stopDone
+		return
+	}
+	defer close(p.stopDone)
+	if strict {
+		atomic.StoreUint32(&p.stopCalls, 1)
+	}
+	if atomic.CompareAndSwapUint32(&p.begun, 0, 1) {
+		// a lazy session which never began.
+		return
+	}
+	if p.skipped {
+		return
+	}
+	if p.done != nil {
+		close(p.done)
+	}
+	p.captures.Wait()
+	if len(p.onStop) > 0 || len(p.afterStop) > 0 {
+		// called once the session is unlocked, so that fn may
+		// call its methods.
+		defer func() {
+			files := p.Files()
+			for _, fn := range p.onStop {
+				fn(files)
+			}
+			r := p.Results()
+			for _, fn := range p.afterStop {
+				fn(r)
+			}
+		}()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.end = time.Now()
+	var before runtime.MemStats
+	if p.overhead != nil {
+		runtime.ReadMemStats(&before)
+	}
+	atomic.StoreUint32(&p.stopping, 1)
+	p.closer()
+	p.writeRings()
+	if len(p.labels) > 0 || p.labelCtx != nil {
+		pprof.SetGoroutineLabels(context.Background())
+	}
+	p.finish()
+	if p.overhead != nil {
+		var after runtime.MemStats
+		runtime.ReadMemStats(&after)
+		p.overhead.Stop = time.Since(p.end)
+		p.overhead.StopAlloc = after.TotalAlloc - before.TotalAlloc
+		p.overhead.StopGCs = after.NumGC - before.NumGC
+		p.writeOverhead()
+	}
+	if p.tar != nil {
+		if err := p.writeTar(); err != nil {
+			p.warnf("profile: could not write tar stream: %v", err)
+		} else {
+			p.logf("profile: profiles written to tar stream")
+		}
+	}
+	atomic.StoreUint32(&p.stopping, 0)
+	if _, ok := p.fs.(osFS); ok && p.webUI {
+		p.openWebUI()
+	}
+	atomic.AddInt32(&sessions, 1)
+	if !p.isolated {
+		atomic.StoreUint32(&started, 0)
+	}
+}
+
+// CaptureAndStop writes the current goroutine and heap profiles to
+// crash-goroutine.pprof and crash-heap.pprof in the output directory,
+// then stops the session. Go has no hook for unrecovered panics, so
+// CaptureAndStop is intended to be called from the program's own
+// top level recover:
+//
+//	p := profile.Start(profile.MemProfile)
+//	defer func() {
+//		if r := recover(); r != nil {
+//			p.CaptureAndStop()
+//			panic(r)
+//		}
+//	}()
+//
+// Calling debug.SetPanicOnFault(true) turns unexpected memory faults
+// into panics which can be recovered, and so captured, in the same way.
+// CaptureAndStop does nothing if the session has already stopped,
+// even under StrictStop.
+func (p *Profile) CaptureAndStop() {
+	p.mu.Lock()
+	if atomic.LoadUint32(&p.stopped) != 0 {
+		// already stopped, Stop would panic under StrictStop.
+		p.mu.Unlock()
+		return
+	}
+	if !p.skipped {
+		for _, c := range []struct {
+			mode int
+			name string
+		}{
+			{goroutineMode, "goroutine"},
+			{memMode, "heap"},
+		} {
+			fn := p.filename("crash-" + c.name + ".pprof")
+			f, err := p.create(c.mode, fn)
+			if err != nil {
+				p.warnf("profile: could not create %s profile %q: %v", c.name, fn, err)
+				continue
+			}
+			if err := p.writeLookup(f, c.name); err != nil {
+				p.discard(f)
+				p.warnf("profile: could not write %s profile %q: %v", c.name, fn, err)
+				continue
+			}
+			if err := p.close(f); err != nil {
+				p.warnf("profile: could not write %s profile %q: %v", c.name, fn, err)
+				continue
+			}
+			p.logf("profile: %s profile captured, %s", c.name, fn)
+		}
+	}
+	p.mu.Unlock()
+	p.Stop()
+}
+
+// Results describes a profiling session.
+type Results struct {
+	// Start and End record the wall clock time at which profiling
+	// started and stopped.
+	// End is zero until Stop has been called.
+	Start, End time.Time
+
+	// Overhead records the cost of the session, if OverheadStats
+	// is set, nil otherwise.
+	Overhead *Overhead
+}
+
+// Overhead describes the cost of managing a profiling session.
+type Overhead struct {
+	// Start and Stop record the time spent in Start and Stop.
+	Start, Stop time.Duration
+
+	// StopAlloc and StopGCs record the bytes allocated, and the
+	// garbage collections completed, while profiles were written on Stop.
+	StopAlloc uint64
+	StopGCs   uint32
+}
+
+// OverheadStats measures the time spent in Start and Stop, and the
+// memory allocated while writing profiles on Stop, and writes them to
+// overhead.txt in the output directory, as well as to the Overhead of
+// Results. The figures help judge whether profiling perturbs the program,
+// though not the cost of sampling itself while profiling runs.
+func OverheadStats(p *Profile) { p.overhead = &Overhead{} }
+
+// writeOverhead writes the overhead of the session to overhead.txt.
+func (p *Profile) writeOverhead() {
+	var buf bytes.Buffer
+	o := p.overhead
+	fmt.Fprintf(&buf, "Session: %v\n", p.end.Sub(p.start))
+	fmt.Fprintf(&buf, "Start: %v\n", o.Start)
+	fmt.Fprintf(&buf, "Stop: %v\n", o.Stop)
+	fmt.Fprintf(&buf, "Stop allocated: %s\n", formatValue(int64(o.StopAlloc), "bytes"))
+	fmt.Fprintf(&buf, "Stop GC cycles: %d\n", o.StopGCs)
+	fn := p.filename("overhead.txt")
+	if err := writeFile(p.fs, fn, buf.Bytes()); err != nil {
+		p.warnf("profile: could not write overhead %q: %v", fn, err)
+		return
+	}
+	p.logf("profile: overhead written to %s", fn)
+}
+
+// Results returns a description of the profiling session.
+// It should be called after Stop.
+func (p *Profile) Results() Results {
+	r := Results{
+		Start: p.start,
+		End:   p.end,
+	}
+	if p.overhead != nil {
+		o := *p.overhead
+		r.Overhead = &o
+	}
+	return r
+}
+
+// timeFormat is the layout of the timestamps logged by Stop.
+const timeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// window describes the wall clock interval covered by the session.
+func (p *Profile) window() string {
+	return p.start.Format(timeFormat) + " to " + p.end.Format(timeFormat)
+}
+
+// event describes the start or end of profiling for JSONLog and Slog.
+// Stop events also hold the duration of profiling and the bytes written.
+type event struct {
+	Event    string        `json:"event"`
+	Mode     string        `json:"mode"`
+	Path     string        `json:"path"`
+	Time     time.Time     `json:"timestamp"`
+	Rate     int           `json:"rate,omitempty"`
+	Duration time.Duration `json:"duration_ns,omitempty"`
+	Bytes    int64         `json:"bytes,omitempty"`
+}
+
+// events reports whether start and stop events are logged in place
+// of the informational messages.
+func (p *Profile) events() bool {
+	return p.jsonLog != nil || p.logEvent != nil
+}
+
+// emit writes ev to the JSON log and the structured logger unless
+// informational messages are suppressed.
+func (p *Profile) emit(ev event) {
+	if p.verbosity < LevelInfo {
+		return
+	}
+	if p.logEvent != nil {
+		p.logEvent(ev)
+	}
+	if p.jsonLog == nil {
+		return
+	}
+	if err := json.NewEncoder(p.jsonLog).Encode(ev); err != nil {
+		p.warnf("profile: could not write json log: %v", err)
+	}
+}
+
+// describe returns a description of mode for informational messages.
+func describe(mode int) string {
+	switch mode {
+	case memMode:
+		return "memory profiling"
+	case threadCreateMode:
+		return "thread creation profiling"
+	case traceMode:
+		return "trace"
+	case flightMode:
+		return "flight recorder"
+	default:
+		return modeName(mode) + " profiling"
+	}
+}
+
+// enabled logs that profiling in mode has started, writing to fn.
+// rate holds the sampling rate of memory profiles.
+func (p *Profile) enabled(mode int, fn string, rate int) {
+	if p.events() {
+		p.emit(event{Event: "start", Mode: modeName(mode), Path: fn, Time: p.start, Rate: rate})
+		return
+	}
+	if mode == memMode || rate > 1 {
+		p.logf("profile: %s enabled (rate %d), %s", describe(mode), rate, fn)
+		return
+	}
+	p.logf("profile: %s enabled, %s", describe(mode), fn)
+}
+
+// disabled logs that profiling in mode has stopped, having written fn.
+func (p *Profile) disabled(mode int, fn string) {
+	if p.events() {
+		p.emit(event{Event: "stop", Mode: modeName(mode), Path: fn, Time: p.end, Duration: p.end.Sub(p.start), Bytes: p.size(fn)})
+		return
+	}
+	p.logf("profile: %s disabled, %s (%s)", describe(mode), fn, p.window())
+}
+
+// logf prints an informational message if the verbosity allows.
+func (p *Profile) logf(format string, args ...interface{}) {
+	if p.verbosity >= LevelInfo {
+		p.printf(format, args...)
+	}
+}
+
+// warnf prints a warning if the verbosity allows. Warnings logged
+// while the profiles are written on Stop are reported by StopErr.
+func (p *Profile) warnf(format string, args ...interface{}) {
+	if atomic.LoadUint32(&p.stopping) != 0 {
+		p.errMu.Lock()
+		if p.stopErr == nil {
+			p.stopErr = fmt.Errorf(format, args...)
+		}
+		p.errMu.Unlock()
+	}
+	p.retryf(format, args...)
+}
+
+// errorf prints a warning as warnf does, recording it to be reported
+// by StopErr even if the session is not being stopped.
+func (p *Profile) errorf(format string, args ...interface{}) {
+	p.errMu.Lock()
+	if p.stopErr == nil {
+		p.stopErr = fmt.Errorf(format, args...)
+	}
+	p.errMu.Unlock()
+	p.retryf(format, args...)
+}
+
+// retryf prints a warning of a failure which is retried, and so is
+// not reported by StopErr, if the verbosity allows.
+func (p *Profile) retryf(format string, args ...interface{}) {
+	if p.verbosity >= LevelWarn {
+		p.printf(format, args...)
+	}
+}
+
+// printf prints a message to the session's logger.
+func (p *Profile) printf(format string, args ...interface{}) {
+	if p.logger != nil {
+		p.logger.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// cgoHintOnce ensures the cgo hint is logged at most once.
+var cgoHintOnce sync.Once
+
+// hintCgo logs a hint about incomplete stacks if cgo calls
+// were made while cpu profiling.
+func (p *Profile) hintCgo(calls int64) {
+	if calls <= 0 || !cgoEnabled() {
+		return
+	}
+	cgoHintOnce.Do(func() {
+		p.logf("profile: %d cgo calls were made while cpu profiling, stacks in C code may be incomplete unless a cgo traceback is registered with runtime.SetCgoTraceback", calls)
+	})
+}
+
+// output records a profile file written during the session.
+type output struct {
+	// name holds the path of the file.
+	name string
+
+	// mode holds the profiling mode which wrote the file.
+	mode int
+
+	// user is set if the file was supplied by File, and
+	// so is not closed or removed by the session.
+	user bool
+
+	// size holds the number of bytes written to the file.
+	size int64
+
+	// stream is set if the file is a writer set by WriteTo, and
+	// so is not listed in the files of the session.
+	stream bool
+
+	// open is set while the file is being written, so that it is
+	// not pruned by MaxFiles or MaxAge.
+	open bool
+}
+
+// size returns the number of bytes written to the profile file fn.
+func (p *Profile) size(fn string) int64 {
+	for _, out := range p.files {
+		if out.name == fn {
+			return atomic.LoadInt64(&out.size)
+		}
+	}
+	return 0
+}
+
+// create creates the named profile file for the given mode
+// and records it as part of this session.
+func (p *Profile) create(mode int, fn string) (io.WriteCloser, error) {
+	if w, ok := p.streams[mode]; ok {
+		// the first file of mode, its profile, is written to w.
+		delete(p.streams, mode)
+		out := &output{name: fn, mode: mode, user: true, stream: true}
+		return &outputFile{WriteCloser: nopCloser{w}, p: p, out: out}, nil
+	}
+	if p.file != nil && fn == p.file.Name() {
+		out := &output{name: fn, mode: mode, user: true}
+		p.files = append(p.files, out)
+		return &outputFile{WriteCloser: p.file, p: p, out: out}, nil
+	}
+	f, err := p.fs.Create(fn)
+	if err != nil {
+		return nil, err
+	}
+	if of, ok := osFile(f); ok && p.preallocate > 0 {
+		if err := preallocate(of, p.preallocate); err != nil {
+			p.warnf("profile: could not preallocate %q: %v", fn, err)
+		}
+	}
+	if p.compressor != nil && isTrace(mode) {
+		w, err := p.compressor(f)
+		if err != nil {
+			f.Close()
+			p.fs.Remove(fn)
+			return nil, err
+		}
+		f = &compressedFile{w: w, f: f}
+	}
+	out := &output{name: fn, mode: mode, open: true}
+	p.files = append(p.files, out)
+	return &outputFile{WriteCloser: f, p: p, out: out}, nil
+}
+
+// compressedFile is a file written through a compressor.
+type compressedFile struct {
+	w io.WriteCloser
+	f io.WriteCloser
+}
+
+func (c *compressedFile) Write(buf []byte) (int, error) { return c.w.Write(buf) }
+
+func (c *compressedFile) Close() error {
+	err := c.w.Close()
+	if cerr := c.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+const (
+	// writeAttempts is the number of times a short or failed
+	// write to a profile file is attempted.
+	writeAttempts = 3
+
+	// writeBackoff is the delay before a write is retried.
+	writeBackoff = 10 * time.Millisecond
+)
+
+// outputFile is a profile file open for writing. Short writes and
+// transient errors are retried, the first hard error is remembered
+// so that the file is marked corrupt when closed, even if the
+// writer ignored it, as the cpu profiler does.
+type outputFile struct {
+	io.WriteCloser
+	p   *Profile
+	out *output
+	err error
+}
+
+func (f *outputFile) Write(buf []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	written := 0
+	err := retry(writeAttempts, writeBackoff, f.p.retryf, func() error {
+		n, err := f.WriteCloser.Write(buf[written:])
+		written += n
+		atomic.AddInt64(&f.out.size, int64(n))
+		if err == nil && written < len(buf) {
+			err = io.ErrShortWrite
+		}
+		return err
+	})
+	if err != nil {
+		f.err = err
+	}
+	return written, err
+}
+
+// close closes a profile file. A file which could not be written
+// in full is renamed to name.corrupt, or removed if the file system
+// cannot rename it, so that no unreadable profile is left behind.
+func (p *Profile) close(f io.WriteCloser) error {
+	of, ok := f.(*outputFile)
+	if !ok {
+		return f.Close()
+	}
+	err := p.closeFile(of.WriteCloser)
+	of.out.open = false
+	if of.err != nil {
+		err = of.err
+	}
+	if err != nil {
+		p.corrupt(of.out, err)
+	}
+	return err
+}
+
+// corrupt sets aside the partially written file out.
+func (p *Profile) corrupt(out *output, err error) {
+	for i, o := range p.files {
+		if o == out {
+			p.files = append(p.files[:i], p.files[i+1:]...)
+			break
+		}
+	}
+	if out.user {
+		p.warnf("profile: %s is incomplete: %v", out.name, err)
+		return
+	}
+	if _, ok := p.fs.(osFS); ok {
+		if rerr := os.Rename(out.name, out.name+".corrupt"); rerr == nil {
+			p.warnf("profile: %s is incomplete, renamed to %s.corrupt: %v", out.name, out.name, err)
+			return
+		}
+	}
+	p.fs.Remove(out.name)
+	p.warnf("profile: %s is incomplete, removed: %v", out.name, err)
+}
+
+// closeFile closes f, syncing it first if requested.
+func (p *Profile) closeFile(f io.WriteCloser) error {
+	if cf, ok := f.(*compressedFile); ok {
+		err := cf.w.Close()
+		if cerr := p.closeFile(cf.f); err == nil {
+			err = cerr
+		}
+		return err
+	}
+	of, ok := osFile(f)
+	if !ok {
+		return f.Close()
+	}
+	if of == p.file {
+		// the caller owns f.
+		if p.sync {
+			return of.Sync()
+		}
+		return nil
+	}
+	if p.preallocate > 0 {
+		// release the space reserved past the data written.
+		if off, err := of.Seek(0, io.SeekCurrent); err == nil {
+			of.Truncate(off)
+		}
+	}
+	if p.sync {
+		if err := of.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// discard closes and removes f, the last file created.
+func (p *Profile) discard(f io.WriteCloser) {
+	if of, ok := f.(*outputFile); ok && of.out.stream {
+		return
+	}
+	out := p.files[len(p.files)-1]
+	if !out.user {
+		f.Close()
+		p.fs.Remove(out.name)
+	}
+	p.files = p.files[:len(p.files)-1]
+}
+
+// modeFile returns the path of the file written by mode, named
+// name in the output directory unless it was supplied by File.
+func (p *Profile) modeFile(mode int, name string) string {
+	if p.file != nil && mode == p.mode {
+		return p.file.Name()
+	}
+	return p.filename(p.baseName(mode, name))
+}
+
+// traceFile returns fn, the execution trace file of mode, with the
+// compressor's extension if one is set and the trace is written to
+// the file system.
+func (p *Profile) traceFile(mode int, fn string) string {
+	if _, ok := p.streams[mode]; ok || p.compressor == nil || (p.file != nil && fn == p.file.Name()) {
+		return fn
+	}
+	return fn + p.compressExt
+}
+
+// filename returns the path of the named profile file in the
+// output directory.
+func (p *Profile) filename(name string) string {
+	if p.nameTemplate != nil {
+		name = p.templateName(name)
+	}
+	if p.autoName {
+		if prefix := programName(); prefix != "" {
+			name = prefix + "-" + name
+		}
+	}
+	if p.correlationID != "" {
+		name = sanitize(p.correlationID) + "-" + name
+	}
+	if p.hostPID != "" {
+		ext := filepath.Ext(name)
+		name = strings.TrimSuffix(name, ext) + "-" + p.hostPID + ext
+	}
+	if p.reason != "" {
+		ext := filepath.Ext(name)
+		name = strings.TrimSuffix(name, ext) + "." + p.reason + ext
+	}
+	fn := filepath.Join(p.path, name)
+	if p.dirPolicy == Number {
+		fn = p.number(fn)
+	}
+	return fn
+}
+
+// templateName returns the name FilenameTemplate makes of name.
+func (p *Profile) templateName(name string) string {
+	ext := filepath.Ext(name)
+	var buf bytes.Buffer
+	err := p.nameTemplate.Execute(&buf, fileName{
+		Name: strings.TrimSuffix(name, ext),
+		Ext:  ext,
+		Time: p.nameTime.UTC().Format(nameTimeFormat),
+		Host: hostname(),
+		PID:  os.Getpid(),
+	})
+	if err == nil && buf.Len() == 0 {
+		err = errors.New("empty name")
+	}
+	if err != nil {
+		p.warnf("profile: could not name %s by template: %v", name, err)
+		return name
+	}
+	return buf.String()
+}
+
+// programName returns the base name of the running program,
+// sanitised for use in a file name.
+func programName() string {
+	name := filepath.Base(os.Args[0])
+	name = strings.TrimSuffix(name, ".exe")
+	return sanitize(name)
+}
+
+// sanitize replaces the characters of s which are not safe to
+// use in a file name.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, strings.Trim(s, "."))
+}
+
+// next returns the name of the next numbered file after fn,
+// e.g. cpu.1.pprof for cpu.pprof. Under the Number directory policy
+// the names of files already in the file system are passed over.
+func (p *Profile) next(fn string) string {
+	if p.flushes == nil {
+		p.flushes = make(map[string]int)
+	}
+	ext := fileExt(fn)
+	for {
+		p.flushes[fn]++
+		name := fmt.Sprintf("%s.%d%s", strings.TrimSuffix(fn, ext), p.flushes[fn], ext)
+		if p.dirPolicy != Number || !p.exists(trimCompressed(name)) {
+			return name
+		}
+	}
+}
+
+// snapshot writes the current state of the runtime/pprof profile
+// written by mode to the next numbered file after fn.
+func (p *Profile) snapshot(mode int, fn string) {
+	name := p.lookup(mode)
+	if p.ringSize > 0 {
+		var buf bytes.Buffer
+		if err := p.writeSnapshot(&buf, mode); err != nil {
+			p.warnf("profile: could not capture %s profile: %v", name, err)
+			return
+		}
+		r := p.ring(mode, fn)
+		r.push(buf.Bytes())
+		p.logf("profile: %s profile snapshot kept in memory, %d of %d", name, len(r.snaps), p.ringSize)
+		return
+	}
+	fn = p.next(fn)
+	f, err := p.create(mode, fn)
+	if err != nil {
+		p.warnf("profile: could not create %s profile %q: %v", name, fn, err)
+		return
+	}
+	if err := p.writeSnapshot(f, mode); err != nil {
+		p.warnf("profile: could not write %s profile %q: %v", name, fn, err)
+	}
+	p.close(f)
+	p.logf("profile: %s profile flushed, %s", name, fn)
+}
+
+// writeSnapshot writes the current state of the runtime/pprof
+// profile written by mode to w.
+func (p *Profile) writeSnapshot(w io.Writer, mode int) error {
+	name := p.lookup(mode)
+	if mode == memMode && p.gcBeforeSnapshot {
+		runtime.GC()
+	}
+	if p.resetOnFlush && (name == "block" || name == "mutex") {
+		return p.transformTo(w, func(w io.Writer) error {
+			return p.writeDelta(w, name)
+		})
+	}
+	return p.writeLookup(w, name)
+}
+
+// writeLookup writes the named runtime/pprof profile to w.
+func (p *Profile) writeLookup(w io.Writer, name string) error {
+	mp := pprof.Lookup(name)
+	if mp == nil {
+		return nil
+	}
+	traceMark(name)
+	return p.transformTo(w, func(w io.Writer) error {
+		if !p.recordDuration || !timed[name] {
+			return mp.WriteTo(w, 0)
+		}
+		var buf bytes.Buffer
+		if err := mp.WriteTo(&buf, 0); err != nil {
+			return err
+		}
+		prof, err := pprofile.ParseData(buf.Bytes())
+		if err != nil {
+			return err
+		}
+		prof.DurationNanos = time.Since(p.start).Nanoseconds()
+		return prof.Write(w)
+	})
+}
+
+// transformTo writes the profile written by write to w,
+// applying the Transform function if there is one.
+func (p *Profile) transformTo(w io.Writer, write func(io.Writer) error) error {
+	if p.transform == nil {
+		return write(w)
+	}
+	var buf bytes.Buffer
+	if err := write(&buf); err != nil {
+		return err
+	}
+	data, err := p.transform(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("transform: %v", err)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// ring holds the most recent snapshots of the profile written to fn.
+type ring struct {
+	mode  int
+	fn    string
+	size  int
+	snaps [][]byte
+}
+
+// push adds snap to r, dropping the oldest snapshot if r is full.
+func (r *ring) push(snap []byte) {
+	if len(r.snaps) == r.size {
+		r.snaps = append(r.snaps[:0], r.snaps[1:]...)
+	}
+	r.snaps = append(r.snaps, snap)
+}
+
+// ring returns the ring of snapshots of the profile written to fn.
+func (p *Profile) ring(mode int, fn string) *ring {
+	for _, r := range p.rings {
+		if r.fn == fn {
+			return r
+		}
+	}
+	r := &ring{mode: mode, fn: fn, size: p.ringSize}
+	p.rings = append(p.rings, r)
+	return r
+}
+
+// writeRings writes the snapshots held in memory to numbered files,
+// oldest first.
+func (p *Profile) writeRings() {
+	for _, r := range p.rings {
+		name := p.lookup(r.mode)
+		for _, snap := range r.snaps {
+			fn := p.next(r.fn)
+			f, err := p.create(r.mode, fn)
+			if err != nil {
+				p.warnf("profile: could not create %s profile %q: %v", name, fn, err)
+				continue
+			}
+			if _, err := f.Write(snap); err != nil {
+				p.warnf("profile: could not write %s profile %q: %v", name, fn, err)
+			}
+			p.close(f)
+			p.logf("profile: %s profile flushed, %s", name, fn)
+		}
+	}
+	p.rings = nil
+}
+
+// capture returns the current state of the named runtime/pprof profile.
+func capture(name string) (*pprofile.Profile, error) {
+	mp := pprof.Lookup(name)
+	if mp == nil {
+		return nil, fmt.Errorf("no %s profile", name)
+	}
+	var buf bytes.Buffer
+	if err := mp.WriteTo(&buf, 0); err != nil {
+		return nil, err
+	}
+	return pprofile.ParseData(buf.Bytes())
+}
+
+// baseline records the current state of the named runtime/pprof
+// profile for writeDelta.
+func (p *Profile) baseline(name string) {
+	prof, err := capture(name)
+	if err != nil {
+		p.warnf("profile: could not capture %s profile baseline: %v", name, err)
+		return
+	}
+	if p.last == nil {
+		p.last = make(map[string]*pprofile.Profile)
+	}
+	p.last[name] = prof
+}
+
+// writeDelta writes the change in the named runtime/pprof profile
+// since the last call to baseline or writeDelta to w.
+func (p *Profile) writeDelta(w io.Writer, name string) error {
+	cur, err := capture(name)
+	if err != nil {
+		return err
+	}
+	d := cur
+	if last := p.last[name]; last != nil {
+		if d, err = delta(cur, last); err != nil {
+			return err
+		}
+	}
+	p.last[name] = cur
+	traceMark(name)
+	return d.Write(w)
+}
+
+// traceMark logs the writing of the named profile to the execution
+// trace, if one is being recorded.
+func traceMark(name string) {
+	if trace.IsEnabled() {
+		trace.Log(context.Background(), "profile", name+" profile written")
+	}
+}
+
+// merge merges the profile files in chunks into the first and
+// removes the rest.
+func (p *Profile) merge(chunks []string) {
+	if len(chunks) < 2 {
+		return
+	}
+	if err := mergeFiles(p.fs, chunks); err != nil {
+		p.warnf("profile: could not merge %q: %v", chunks, err)
+		return
+	}
+	removed := make(map[string]bool)
+	for _, fn := range chunks[1:] {
+		removed[fn] = true
+	}
+	files := p.files[:0]
+	for _, out := range p.files {
+		if !removed[out.name] {
+			files = append(files, out)
+		}
+	}
+	p.files = files
+	p.logf("profile: merged %d profiles into %s", len(chunks), chunks[0])
+}
+
+// writer returns the writer streamed profiles should be written
+// to in place of w.
+func (p *Profile) writer(w io.Writer) io.Writer {
+	if p.maxBytes > 0 {
+		w = &limitWriter{w: w, p: p}
+	}
+	if p.rotateSize > 0 {
+		w = &rotateWriter{w: w, p: p}
+	}
+	return w
+}
+
+// tee copies a streamed profile to several destinations.
+type tee struct {
+	p      *Profile
+	dsts   []io.Writer
+	failed []bool
+}
+
+func newTee(p *Profile, dsts []io.Writer) *tee {
+	return &tee{p: p, dsts: dsts, failed: make([]bool, len(dsts))}
+}
+
+// writer returns a writer which writes to w and to each of the
+// destinations of t. Only errors from w are returned.
+func (t *tee) writer(w io.Writer) io.Writer {
+	return &teeWriter{w: w, t: t}
+}
+
+// close flushes and closes each destination which supports it.
+func (t *tee) close() {
+	for i, d := range t.dsts {
+		if f, ok := d.(interface{ Flush() error }); ok {
+			if err := f.Flush(); err != nil {
+				t.p.warnf("profile: could not flush tee destination %d: %v", i, err)
+			}
+		}
+		if c, ok := d.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				t.p.warnf("profile: could not close tee destination %d: %v", i, err)
+			}
+		}
+	}
+}
+
+type teeWriter struct {
+	w io.Writer
+	t *tee
+}
+
+func (tw *teeWriter) Write(buf []byte) (int, error) {
+	n, err := tw.w.Write(buf)
+	for i, d := range tw.t.dsts {
+		if tw.t.failed[i] {
+			continue
+		}
+		if _, err := d.Write(buf[:n]); err != nil {
+			tw.t.p.warnf("profile: could not write to tee destination %d, dropping it: %v", i, err)
+			tw.t.failed[i] = true
+		}
+	}
+	return n, err
+}
+
+// limitWriter stops its profile after maxBytes have been written.
+type limitWriter struct {
+	w io.Writer
+	p *Profile
+}
+
+func (l *limitWriter) Write(buf []byte) (int, error) {
+	n, err := l.w.Write(buf)
+	total := atomic.AddInt64(&l.p.written, int64(n))
+	if over := total - int64(n); over < l.p.maxBytes && total >= l.p.maxBytes {
+		l.p.warnf("profile: %d bytes written, limit of %d bytes reached, stopping profiling", total, l.p.maxBytes)
+		// Stop waits for the profile writer, which is calling
+		// Write, so it must run on another goroutine.
+		go l.p.stop(false)
+	}
+	return n, err
+}
+
+// finish post-processes the files written during this session
+// once they have been flushed and closed.
+func (p *Profile) finish() {
+	if p.omitEmpty {
+		p.removeEmpty()
+	}
+	var report bytes.Buffer
+	for _, out := range p.files {
+		fn := out.name
+		if len(p.labelFilters) > 0 && (out.mode == cpuMode || out.mode == goroutineMode || out.mode == customMode) {
+			// other profiles record no labels, and custom ones
+			// only if their samples were added with them.
+			var before, after int
+			unlabelled := false
+			err := rewrite(p.fs, fn, func(prof *pprofile.Profile) (*pprofile.Profile, error) {
+				if out.mode == customMode && !hasLabels(prof) {
+					unlabelled = true
+					return prof, nil
+				}
+				before = len(prof.Sample)
+				prof = filterLabels(prof, p.labelFilters)
+				after = len(prof.Sample)
+				return prof, nil
+			})
+			if err != nil {
+				p.warnf("profile: could not filter %q: %v", fn, err)
+			} else if !unlabelled {
+				p.logf("profile: filtered %s by labels, kept %d of %d samples", fn, after, before)
+			}
+		}
+		if p.deterministic && p.lookup(out.mode) != "" {
+			err := rewrite(p.fs, fn, func(prof *pprofile.Profile) (*pprofile.Profile, error) {
+				return sortProfile(prof), nil
+			})
+			if err != nil {
+				p.warnf("profile: could not sort %q: %v", fn, err)
+			}
+		}
+		if comments := p.comments(); len(comments) > 0 && !isTrace(out.mode) {
+			err := rewrite(p.fs, fn, func(prof *pprofile.Profile) (*pprofile.Profile, error) {
+				prof.Comments = append(prof.Comments, comments...)
+				return prof, nil
+			})
+			if err != nil {
+				p.warnf("profile: could not comment %q: %v", fn, err)
+			}
+		}
+		if p.textReport && !isTrace(out.mode) {
+			if err := p.report(&report, fn); err != nil {
+				p.warnf("profile: skipping text report of %q: %v", fn, err)
+			}
+		}
+		if p.memViews && out.mode == memMode {
+			p.writeViews(fn)
+		}
+		if p.foldedStacks && (out.mode == cpuMode || out.mode == memMode) {
+			p.writeFolded(fn)
+		}
+		if p.compress && !out.user {
+			gz, err := compressOver(p.fs, fn, int64(p.compressOver))
+			if err != nil {
+				// the uncompressed profile is still complete.
+				p.warnf("profile: could not compress %q: %v", fn, err)
+			} else if gz != fn {
+				p.logf("profile: compressed %s to %s", fn, gz)
+				out.name = gz
+			}
+		}
+		if p.verify {
+			if err := p.verifyFile(out.name, out.mode); err != nil {
+				p.warnf("profile: %s is not a valid profile: %v", out.name, err)
+			} else {
+				p.logf("profile: verified %s", out.name)
+			}
+		}
+		if p.uploadURL != "" {
+			if err := upload(p.fs, p.uploadURL, out.name, modeName(out.mode)); err != nil {
+				p.warnf("profile: could not upload %q: %v", out.name, err)
+				continue
+			}
+			p.logf("profile: uploaded %s to %s", out.name, p.uploadURL)
+		}
+	}
+	p.prune()
+	if report.Len() > 0 {
+		fn := p.filename("report.txt")
+		if err := writeFile(p.fs, fn, report.Bytes()); err != nil {
+			p.warnf("profile: could not write text report %q: %v", fn, err)
+		} else {
+			p.logf("profile: text report written to %s", fn)
+		}
+	}
+	if p.flamegraph {
+		p.writeFlamegraph()
+	}
+	if p.latestSymlink && len(p.files) > 0 {
+		p.linkLatest()
+	}
+	if p.indexHTML && len(p.files) > 0 {
+		fn := p.filename("index.html")
+		if err := p.writeIndex(fn); err != nil {
+			p.warnf("profile: could not write index %q: %v", fn, err)
+		} else {
+			p.logf("profile: index written to %s", fn)
+		}
+	}
+}
+
+// indexTemplate is the page written by IndexHTML.
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Profiles</title>
+</head>
+<body>
+<h1>Profiles</h1>
+<p>Recorded {{.Start}} to {{.End}}. Open a profile by running its command in this directory.</p>
+<table>
+<tr><th>Profile</th><th>Command</th></tr>
+{{range .Files}}<tr><td><a href="{{.Name}}">{{.Name}}</a></td><td><code>{{.Command}}</code></td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// writeIndex writes an index.html listing the files of the session,
+// and the command which opens each, to fn.
+func (p *Profile) writeIndex(fn string) error {
+	type file struct{ Name, Command string }
+	var files []file
+	for _, out := range p.files {
+		name, err := filepath.Rel(p.path, out.name)
+		if err != nil {
+			name = out.name
+		}
+		name = filepath.ToSlash(name)
+		cmd := "go tool pprof -http=:0 " + name
+		if isTrace(out.mode) {
+			cmd = "go tool trace " + name
+		}
+		files = append(files, file{Name: name, Command: cmd})
+	}
+	var buf bytes.Buffer
+	err := indexTemplate.Execute(&buf, map[string]interface{}{
+		"Start": p.start.Format(time.RFC3339),
+		"End":   p.end.Format(time.RFC3339),
+		"Files": files,
+	})
+	if err != nil {
+		return err
+	}
+	return writeFile(p.fs, fn, buf.Bytes())
+}
+
+// report appends a text report of the pprof profile stored in fn to buf.
+func (p *Profile) report(buf *bytes.Buffer, fn string) error {
+	data, err := readFile(p.fs, fn)
+	if err != nil {
+		return err
+	}
+	prof, err := pprofile.ParseData(data)
+	if err != nil {
+		return err
+	}
+	if buf.Len() > 0 {
+		buf.WriteString("\n")
+	}
+	return textReport(buf, filepath.Base(fn), prof, reportTop)
+}
+
+// writeViews writes a text report of each of memViews of the memory
+// profile fn to a file named after fn and the view.
+func (p *Profile) writeViews(fn string) {
+	data, err := readFile(p.fs, fn)
+	if err == nil {
+		var prof *pprofile.Profile
+		if prof, err = pprofile.ParseData(data); err == nil {
+			for _, view := range memViews {
+				p.writeView(fn, prof, view)
+			}
+			return
+		}
+	}
+	p.warnf("profile: could not read memory profile %q: %v", fn, err)
+}
+
+// writeView writes a text report of the view sample type of prof.
+func (p *Profile) writeView(fn string, prof *pprofile.Profile, view string) {
+	found := false
+	for _, st := range prof.SampleType {
+		found = found || st.Type == view
+	}
+	if !found {
+		p.warnf("profile: memory profile %q has no %s samples", fn, view)
+		return
+	}
+	prof.DefaultSampleType = view
+	var buf bytes.Buffer
+	if err := textReport(&buf, filepath.Base(fn), prof, reportTop); err != nil {
+		p.warnf("profile: skipping %s report of %q: %v", view, fn, err)
+		return
+	}
+	name := strings.TrimSuffix(fn, filepath.Ext(fn)) + "-" + view + ".txt"
+	if err := writeFile(p.fs, name, buf.Bytes()); err != nil {
+		p.warnf("profile: could not write %s report %q: %v", view, name, err)
+		return
+	}
+	p.logf("profile: %s report written to %s", view, name)
+}
+
+// openWebUI starts a web UI for each profile written.
+func (p *Profile) openWebUI() {
+	gocmd, err := exec.LookPath("go")
+	if err != nil {
+		p.logf("profile: go command not found, not opening web ui: %v", err)
+		return
+	}
+	for _, out := range p.files {
+		args := []string{"tool", "pprof", "-http=:0", out.name}
+		if isTrace(out.mode) {
+			args = []string{"tool", "trace", out.name}
+		}
+		cmd := exec.Command(gocmd, args...)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Start(); err != nil {
+			p.warnf("profile: could not open web ui for %q: %v", out.name, err)
+			continue
+		}
+		p.logf("profile: opening web ui for %s", out.name)
+		go cmd.Wait()
+	}
+}
+
+// uploadTimeout bounds the time taken to upload a single profile.
+const uploadTimeout = 30 * time.Second
+
+// upload POSTs the contents of fn in fsys to url.
+func upload(fsys FileSystem, url, fn, mode string) error {
+	f, err := fsys.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	req, err := http.NewRequest("POST", url, f)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Profile-Mode", mode)
+	req.Header.Set("X-Profile-Name", filepath.Base(fn))
+	client := http.Client{Timeout: uploadTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// lookup returns the name of the runtime/pprof profile written
+// by the given mode, or "" if the mode streams its output.
+func (p *Profile) lookup(mode int) string {
+	switch mode {
+	case memMode:
+		return p.memProfileType
+	case mutexMode:
+		return "mutex"
+	case blockMode:
+		return "block"
+	case threadCreateMode:
+		return "threadcreate"
+	case goroutineMode:
+		return "goroutine"
+	case customMode:
+		return p.customProfile
+	default:
+		return ""
+	}
+}
+
+// startCPUProfile starts cpu profiling to w at the preferred rate.
+func (p *Profile) startCPUProfile(w io.Writer) error {
+	if hz := p.cpuProfileRate; hz != 0 {
+		// pprof.StartCPUProfile sets the default rate only if
+		// no rate has been set, so it must be set beforehand.
+		// The runtime reports that it ignored the default rate.
+		runtime.SetCPUProfileRate(hz)
+	}
+	return pprof.StartCPUProfile(w)
+}
+
+// isTrace reports whether the files written by mode are
+// execution traces rather than pprof profiles.
+func isTrace(mode int) bool {
+	return mode == traceMode || mode == flightMode
+}
+
+// modeName returns the name of the given profiling mode.
+func modeName(mode int) string {
+	switch mode {
+	case cpuMode:
+		return "cpu"
+	case memMode:
+		return "mem"
+	case mutexMode:
+		return "mutex"
+	case blockMode:
+		return "block"
+	case traceMode:
+		return "trace"
+	case threadCreateMode:
+		return "threadcreate"
+	case goroutineMode:
+		return "goroutine"
+	case clockMode:
+		return "clock"
+	case pmuMode:
+		return "pmu"
+	case flightMode:
+		return "flight"
+	case customMode:
+		return "custom"
+	default:
+		return "unknown"
+	}
+}
+
+// compressOver gzip compresses fn into fn.gz, removing the original,
+// if fn is larger than n bytes and not already gzip compressed.
+// It returns the name of the resulting file.
+func compressOver(fsys FileSystem, fn string, n int64) (string, error) {
+	size, err := fileSize(fsys, fn)
+	if err != nil {
+		return "", err
+	}
+	if size <= n {
+		return fn, nil
+	}
+	src, err := fsys.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	r := bufio.NewReader(src)
+	if magic, err := r.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		// already compressed
+		src.Close()
+		return fn, nil
+	}
+	gz := fn + ".gz"
+	err = func() error {
+		defer src.Close()
+		dst, err := fsys.Create(gz)
+		if err != nil {
+			return err
+		}
+		w := gzip.NewWriter(dst)
+		if _, err := io.Copy(w, r); err != nil {
+			dst.Close()
+			return err
+		}
+		if err := w.Close(); err != nil {
+			dst.Close()
+			return err
+		}
+		return dst.Close()
+	}()
+	if err != nil {
+		fsys.Remove(gz)
+		return "", err
+	}
+	return gz, fsys.Remove(fn)
+}
+
+// gunzip returns the decompressed contents of the gzip data.
+func gunzip(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// fail records err as the first invalid option setting.
+func (p *Profile) fail(err error) {
+	if p.invalid == nil {
+		p.invalid = err
+	}
+}
+
+// check returns the first invalid option setting, and compiles
+// the label filters.
+func (p *Profile) check() error {
+	if p.invalid != nil {
+		return p.invalid
+	}
+	for _, mode := range p.modes() {
+		if mode == customMode && pprof.Lookup(p.customProfile) == nil {
+			return fmt.Errorf("no profile named %q is registered", p.customProfile)
+		}
+	}
+	for _, f := range p.labelFilters {
+		re, err := regexp.Compile(f.expr)
+		if err != nil {
+			return fmt.Errorf("invalid label filter %q: %v", f.expr, err)
+		}
+		f.re = re
+	}
+	return nil
+}
+
+// newProfile returns a Profile configured by options.
+func newProfile(options []func(*Profile)) *Profile {
+	prof := &Profile{
+		verbosity:    LevelInfo,
+		minFreeSpace: DefaultMinFreeSpace,
+		dirAttempts:  DefaultDirAttempts,
+		fs:           osFS{},
+		extractLabel: valueLabel,
+		stopDone:     make(chan struct{}),
+	}
+	for _, option := range options {
+		option(prof)
+	}
+	if path := os.Getenv(PathEnv); path != "" && !prof.capture {
+		prof.path = path
+	}
+	if fs, ok := prof.fs.(osFS); ok {
+		if prof.fileMode != 0 {
+			fs.perm = prof.fileMode
+		}
+		fs.atomic = fs.atomic || prof.atomic
+		prof.fs = fs
+	}
+	if prof.tar != nil {
+		prof.fs = newBufferFS()
+	}
+	return prof
+}
+
+// probeName is the name of the file Validate writes to check
+// the output directory is writable.
+const probeName = ".profile-probe"
+
+// Validate applies options as Start would and returns the first
+// problem Start would report, without profiling. It checks the
+// option settings, creates the output directory and writes and
+// removes a probe file in it, and checks the free space on its
+// file system. A temporary output directory is removed again.
+// Validate lets a program fail fast on a misconfigured session.
+func Validate(options ...func(*Profile)) error {
+	prof := newProfile(options)
+	if err := prof.check(); err != nil {
+		return err
+	}
+	for _, mode := range prof.modes() {
+		if mode == pmuMode {
+			if err := checkPMU(prof.pmuEvent); err != nil {
+				return err
+			}
+		}
+	}
+	if prof.file != nil && len(prof.modes()) == 1 {
+		// the only file written is supplied by the caller.
+		return nil
+	}
+	if prof.path == "" && prof.streamed() {
+		// nothing is written to the output directory.
+		return nil
+	}
+
+	path, temp := prof.path, prof.path == ""
+	err := retry(prof.dirAttempts, dirBackoff, prof.warnf, func() error {
+		if !temp {
+			return prof.fs.MkdirAll(path, prof.dirPerm())
+		}
+		var err error
+		path, err = prof.fs.MkdirTemp(prof.tempRoot, "profile")
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not create output directory: %v", err)
+	}
+	if temp {
+		defer prof.fs.Remove(path)
+	}
+
+	probe := filepath.Join(path, probeName)
+	if err := writeFile(prof.fs, probe, nil); err != nil {
+		return fmt.Errorf("output directory %q is not writable: %v", path, err)
+	}
+	if err := prof.fs.Remove(probe); err != nil {
+		return fmt.Errorf("could not remove probe file %q: %v", probe, err)
+	}
+	if err := prof.checkDir(path); err != nil {
+		return err
+	}
+
+	if _, ok := prof.fs.(osFS); ok && prof.minFreeSpace > 0 {
+		if free, ok, err := freeSpace(path); err == nil && ok && free < prof.minFreeSpace {
+			return fmt.Errorf("insufficient free space in %q: %d bytes available, %d required", path, free, prof.minFreeSpace)
+		}
+	}
+	return nil
+}
+
+// Run starts a profiling session with options, calls fn, and stops the
+// session when fn returns or panics, so that a program structured as
+//
+//	func main() {
+//		profile.Run(realMain, profile.CPUProfile)
+//	}
+//
+// always writes its profiles. A call to os.Exit, or log.Fatal, inside fn
+// exits the program at once, without stopping the session, so fn should
+// return instead and leave the exit to main.
+func Run(fn func(), options ...func(*Profile)) {
+	defer Start(options...).Stop()
+	fn()
+}
+
+// started is non zero if a profile is running.
+var started uint32
+
+// maxSessions holds the limit set by MaxSessions, and sessions the
+// number of sessions completed.
+var maxSessions, sessions int32
+
+// MaxSessions limits the number of sessions the process may run to n,
+// as a guard against a faulty trigger, such as a signal or a request
+// handler, profiling over and over. Once n sessions have been stopped
+// Start logs a warning and returns a session which does nothing.
+// A limit of zero, the default, removes the limit.
+func MaxSessions(n int) {
+	atomic.StoreInt32(&maxSessions, int32(n))
+}
+
+// Start starts a new profiling session.
+// The caller should call the Stop method on the value returned
+// to cleanly stop profiling.
+func Start(options ...func(*Profile)) *Profile {
+	prof, err := StartErr(options...)
+	if err != nil {
+		log.Fatalf("profile: %v", err)
+	}
+	return prof
+}
+
+// StartErr starts a new profiling session as Start does, but returns
+// an error, rather than exiting the program, if the session cannot be
+// started, for libraries which should not decide that a profiling
+// failure is fatal. Nothing is left running after an error.
+func StartErr(options ...func(*Profile)) (*Profile, error) {
+	now := time.Now()
+	prof := newProfile(options)
+	if err := prof.check(); err != nil {
+		return nil, err
+	}
+
+	if prof.lazy {
+		return prof, nil
+	}
+	prof.begun = 1
+	if err := prof.activate(now); err != nil {
+		return nil, err
+	}
+	return prof, nil
+}
+
+// StartWithContext starts a new profiling session as Start does, and
+// stops it, writing the profiles, once ctx is done, so that profiling
+// ends with the rest of the program's work on shutdown. Stop may still
+// be called, and waits for a session being stopped by ctx to finish,
+// so a program exiting when ctx is canceled should call it to be sure
+// the profiles are complete.
+func StartWithContext(ctx context.Context, options ...func(*Profile)) *Profile {
+	p := Start(options...)
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.stop(false)
+		case <-p.stopDone:
+		}
+	}()
+	return p
+}
+
+// Begin starts profiling in a session returned by Start with the
+// Lazy option. It does nothing if the session has already begun or
+// has been stopped, and must not be called concurrently with Stop.
+// As Start does, it exits the program if profiling cannot be started,
+// see BeginErr.
+func (p *Profile) Begin() {
+	if err := p.BeginErr(); err != nil {
+		log.Fatalf("profile: %v", err)
+	}
+}
+
+// BeginErr starts profiling as Begin does, but returns an error, rather
+// than exiting the program, if profiling cannot be started, as StartErr
+// does. Nothing is left running after an error, and Stop then does
+// nothing.
+func (p *Profile) BeginErr() error {
+	if atomic.CompareAndSwapUint32(&p.begun, 0, 1) {
+		if err := p.activate(time.Now()); err != nil {
+			p.skipped = true
+			return err
+		}
+	}
+	return nil
+}
+
+// activate starts the session, Start having been called at now.
+// The session is not started if an error is returned.
+func (p *Profile) activate(now time.Time) (err error) {
+	p.nameTime = now
+	if p.when != nil && !p.when() {
+		p.logf("profile: condition not met, profiling disabled")
+		p.skipped = true
+		return nil
+	}
+
+	if limit := atomic.LoadInt32(&maxSessions); limit > 0 && atomic.LoadInt32(&sessions) >= limit {
+		p.warnf("profile: limit of %d sessions reached, profiling disabled", limit)
+		p.skipped = true
+		return nil
+	}
+
+	if p.heapLimit > 0 {
+		if heap := heapAlloc(); heap >= p.heapLimit {
+			p.warnf("profile: heap of %d bytes reached limit of %d bytes, profiling disabled", heap, p.heapLimit)
+			p.skipped = true
+			return nil
+		}
+	}
+
+	if !p.isolated && !atomic.CompareAndSwapUint32(&started, 0, 1) {
+		return errors.New("Start() already called")
+	}
+	defer func() {
+		if err != nil && !p.isolated {
+			atomic.StoreUint32(&started, 0)
+		}
+	}()
+
+	for _, fn := range p.beforeStart {
+		fn(now)
+	}
+
+	var path string
+	err = retry(p.dirAttempts, dirBackoff, p.warnf, func() error {
+		if p.file != nil && len(p.modes()) == 1 {
+			// the only file written is supplied by the caller.
+			path = filepath.Dir(p.file.Name())
+			return nil
+		}
+		if p.path == "" && p.streamed() {
+			// nothing is written to the output directory.
+			return nil
+		}
+		if path = p.path; path != "" {
+			return p.fs.MkdirAll(path, p.dirPerm())
+		}
+		var err error
+		path, err = p.fs.MkdirTemp(p.tempRoot, "profile")
+		return err
+	})
+
+	if err != nil {
+		return fmt.Errorf("could not create initial output directory: %v", err)
+	}
+	p.path = path
+
+	if err := p.checkDir(path); err != nil {
+		return err
+	}
+	if _, ok := p.fs.(osFS); ok && p.minFreeSpace > 0 {
+		if free, ok, err := freeSpace(path); err == nil && ok && free < p.minFreeSpace {
+			return fmt.Errorf("insufficient free space in %q: %d bytes available, %d required", path, free, p.minFreeSpace)
+		}
+	}
+
+	// cleaning is destructive, so it follows every other check.
+	if _, ok := p.fs.(osFS); ok && p.dirPolicy == Clean {
+		p.clean()
+	}
+
+	if p.memProfileType == "" {
+		p.memProfileType = "heap"
+	}
+
+	if p.invocation {
+		p.writeInvocation()
+	}
+
+	if len(p.meta) > 0 {
+		p.writeMeta()
+	}
+
+	p.prune()
+
+	if p.affinityNote {
+		if cpus, ok, err := cpuAffinity(); err != nil {
+			p.warnf("profile: could not read cpu affinity: %v", err)
+		} else if ok {
+			p.affinity = cpus
+		}
+	}
+
+	if p.labelCtx != nil {
+		for _, key := range p.labelKeys {
+			if v, ok := p.extractLabel(p.labelCtx, key); ok {
+				p.labels = append(p.labels, key, v)
+			}
+		}
+		pprof.SetGoroutineLabels(pprof.WithLabels(p.labelCtx, pprof.Labels(p.labels...)))
+	} else if len(p.labels) > 0 {
+		pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), pprof.Labels(p.labels...)))
+	}
+
+	for _, fn := range p.onStart {
+		fn(p.path)
+	}
+
+	p.closer = func() {}
+	if p.continuousInterval > 0 || p.signal != nil || p.heapLimit > 0 || p.duration > 0 || p.maxFiles > 0 || p.maxAge > 0 {
+		p.done = make(chan struct{})
+	}
+	if p.continuousInterval > 0 {
+		go p.continuous()
+	}
+	if p.heapLimit > 0 {
+		go p.watchPressure()
+	}
+	if p.maxFiles > 0 || p.maxAge > 0 {
+		go p.retain()
+	}
+	if p.signal != nil {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, p.signal)
+		p.logf("profile: profiling on %v", p.signal)
+		p.captures.Add(1)
+		go p.onSignal(c)
+	} else if p.minGoroutines > 0 || p.startAfter != nil || p.delay > 0 {
+		if p.delay > 0 {
+			p.logf("profile: waiting %v before profiling", p.delay)
+		}
+		if p.minGoroutines > 0 {
+			p.logf("profile: waiting for %d goroutines before profiling", p.minGoroutines)
+		}
+		if p.startAfter != nil {
+			p.logf("profile: waiting for counter to reach %d before profiling", p.startAfterThreshold)
+		}
+		go p.await()
+	} else if err := p.begin(); err != nil {
+		if p.done != nil {
+			close(p.done)
+		}
+		if len(p.labels) > 0 || p.labelCtx != nil {
+			pprof.SetGoroutineLabels(context.Background())
+		}
+		return err
+	}
+	if p.overhead != nil {
+		p.overhead.Start = time.Since(now)
+	}
+
+	if !p.isolated && !p.noShutdownHook && (p.shutdownHook || !underTest()) {
+		if p.signalAction == FlushAndContinue {
+			go p.flushOnInterrupt()
+			return nil
+		}
+		go func() {
+			c := make(chan os.Signal, 1)
+			signal.Notify(c, os.Interrupt)
+			<-c
+
+			p.printf("profile: caught interrupt, stopping profiles")
+			p.stop(false)
+
+			os.Exit(0)
+		}()
+	}
+	return nil
+}
+
+// flushOnInterrupt flushes the session each time the program
+// receives SIGINT, until Stop.
+func (p *Profile) flushOnInterrupt() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	defer signal.Stop(c)
+	for {
+		select {
+		case <-p.stopDone:
+			return
+		case <-c:
+			p.printf("profile: caught interrupt, flushing profiles")
+			p.Flush()
+		}
+	}
+}
+
+// traceLog logs the TraceLog message to the execution trace
+// with the given suffix.
+func (p *Profile) traceLog(suffix string) {
+	if p.traceMessage != "" {
+		trace.Log(context.Background(), p.traceCategory, p.traceMessage+": "+suffix)
+	}
+}
+
+// begin starts profiling in each of the session's modes. If a mode
+// cannot be started those already started are stopped.
+func (p *Profile) begin() error {
+	p.start = time.Now()
+	var closers, flushes []func()
+	if p.setGCPercent {
+		old := debug.SetGCPercent(p.gcPercent)
+		p.logf("profile: gc percent set to %d", p.gcPercent)
+		closers = append(closers, func() {
+			debug.SetGCPercent(old)
+			p.logf("profile: gc percent restored to %d", old)
+		})
+	}
+	for _, mode := range p.modes() {
+		closer, flush, err := p.startMode(mode)
+		if err != nil {
+			for i := len(closers) - 1; i >= 0; i-- {
+				closers[i]()
+			}
+			return err
+		}
+		if closer != nil {
+			closers = append(closers, closer)
+		}
+		if flush != nil {
+			flushes = append(flushes, flush)
+		}
+	}
+	p.closer = func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}
+	p.flush = func() {
+		for _, flush := range flushes {
+			flush()
 		}
 	}
+	if p.duration > 0 {
+		go p.stopAfter()
+	}
+	return nil
+}
+
+// goroutinePoll is the interval at which the number of goroutines,
+// and the StartAfter counter, are checked.
+const goroutinePoll = 10 * time.Millisecond
 
-	if prof.memProfileType == "" {
-		prof.memProfileType = "heap"
+// await begins profiling once the delay has passed, the number of
+// goroutines reaches minGoroutines, or the timeout passes, and the
+// StartAfter counter reaches its threshold, unless the session is
+// stopped first.
+func (p *Profile) await() {
+	var deadline time.Time
+	if p.minGoroutinesTimeout > 0 {
+		deadline = time.Now().Add(p.minGoroutinesTimeout)
+	}
+	notBefore := time.Now().Add(p.delay)
+	t := time.NewTicker(goroutinePoll)
+	defer t.Stop()
+	for range t.C {
+		if atomic.LoadUint32(&p.stopped) != 0 {
+			return
+		}
+		n := runtime.NumGoroutine()
+		expired := !deadline.IsZero() && time.Now().After(deadline)
+		if n < p.minGoroutines && !expired || !p.counted() || time.Now().Before(notBefore) {
+			continue
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if atomic.LoadUint32(&p.stopped) != 0 {
+			return
+		}
+		if n < p.minGoroutines {
+			p.warnf("profile: %d goroutines not reached within %v, profiling with %d", p.minGoroutines, p.minGoroutinesTimeout, n)
+		}
+		if err := p.begin(); err != nil {
+			// Start has long returned, so the failure is reported
+			// rather than ending the program.
+			p.errorf("profile: could not begin profiling: %v", err)
+		}
+		return
 	}
+}
 
-	switch prof.mode {
+// startMode starts profiling in the given mode, returning functions
+// which stop and flush it, or an error if it could not be started.
+func (p *Profile) startMode(mode int) (closer, flush func(), err error) {
+	switch mode {
 	case cpuMode:
-		fn := filepath.Join(path, "cpu.pprof")
-		f, err := os.Create(fn)
+		fn := p.modeFile(mode, "cpu.pprof")
+		windows := p.continuousCPU && p.continuousInterval > 0 && (p.file == nil || mode != p.mode)
+		if windows {
+			fn = p.filename("cpu-" + time.Now().UTC().Format(continuousFormat) + ".pprof")
+		}
+		f, err := p.create(mode, fn)
 		if err != nil {
-			log.Fatalf("profile: could not create cpu profile %q: %v", fn, err)
+			return nil, nil, fmt.Errorf("could not create cpu profile %q: %v", fn, err)
+		}
+		p.enabled(mode, fn, 0)
+		cgoCalls := runtime.NumCgoCall()
+		t := newTee(p, p.tee)
+		if hz := p.cpuProfileRate; hz != 0 {
+			p.logf("profile: cpu profile rate set to %d Hz, a runtime warning that it cannot set the rate refers to its default and is harmless", hz)
 		}
-		logf("profile: cpu profiling enabled, %s", fn)
-		pprof.StartCPUProfile(f)
-		prof.closer = func() {
+		if err := p.startCPUProfile(p.writer(t.writer(f))); err != nil {
+			p.discard(f)
+			if !p.isolated {
+				return nil, nil, fmt.Errorf("could not start cpu profile: %v", err)
+			}
+			p.warnf("profile: could not start cpu profile: %v", err)
+			return nil, nil, nil
+		}
+		cur := fn
+		chunks := []string{fn}
+		// stopped is set once the cpu profile could not be restarted
+		// after a rotation, leaving nothing more to rotate or close.
+		stopped := false
+		rotate := func(next string) (string, bool) {
+			if stopped {
+				return "", false
+			}
+			nf, err := p.create(mode, next)
+			if err != nil {
+				p.warnf("profile: could not create cpu profile %q: %v", next, err)
+				return "", false
+			}
 			pprof.StopCPUProfile()
-			f.Close()
-			logf("profile: cpu profiling disabled, %s", fn)
+			p.close(f)
+			if err := p.startCPUProfile(p.writer(t.writer(nf))); err != nil {
+				p.discard(nf)
+				p.warnf("profile: could not restart cpu profile, no longer profiling: %v", err)
+				stopped = true
+				return cur, true
+			}
+			old := cur
+			f, cur = nf, next
+			return old, true
+		}
+		flush = func() {
+			if _, ok := rotate(p.next(fn)); ok && !stopped {
+				chunks = append(chunks, cur)
+				p.logf("profile: cpu profile rotated, %s", cur)
+			}
+		}
+		if windows {
+			p.rotateCPU = rotate
+			flush = func() { p.rotateWindow(time.Now()) }
+		}
+		closer = func() {
+			if !stopped {
+				pprof.StopCPUProfile()
+				p.close(f)
+			}
+			t.close()
+			p.disabled(mode, cur)
+			if p.mergeOnStop {
+				p.merge(chunks)
+			}
+			if p.cgoHint {
+				p.hintCgo(runtime.NumCgoCall() - cgoCalls)
+			}
 		}
 
 	case memMode:
-		fn := filepath.Join(path, "mem.pprof")
-		f, err := os.Create(fn)
+		fn := p.modeFile(mode, "mem.pprof")
+		f, err := p.create(mode, fn)
 		if err != nil {
-			log.Fatalf("profile: could not create memory profile %q: %v", fn, err)
+			return nil, nil, fmt.Errorf("could not create memory profile %q: %v", fn, err)
 		}
 		old := runtime.MemProfileRate
-		runtime.MemProfileRate = prof.memProfileRate
-		logf("profile: memory profiling enabled (rate %d), %s", runtime.MemProfileRate, fn)
-		prof.closer = func() {
-			pprof.Lookup(prof.memProfileType).WriteTo(f, 0)
-			f.Close()
+		runtime.MemProfileRate = p.memProfileRate
+		if p.heapDelta {
+			runtime.GC()
+			base, err := capture("heap")
+			if err != nil {
+				p.warnf("profile: could not capture heap baseline: %v", err)
+			}
+			p.heapBase = base
+		}
+		p.enabled(mode, fn, runtime.MemProfileRate)
+		flush = func() { p.snapshot(mode, fn) }
+		closer = func() {
+			if p.gcBeforeSnapshot {
+				runtime.GC()
+			}
+			if err := p.writeLookup(f, p.memProfileType); err != nil {
+				p.warnf("profile: could not write memory profile %q: %v", fn, err)
+			}
+			p.close(f)
+			if p.heapBase != nil {
+				p.writeHeapDelta()
+			}
 			runtime.MemProfileRate = old
-			logf("profile: memory profiling disabled, %s", fn)
+			p.disabled(mode, fn)
 		}
 
 	case mutexMode:
-		fn := filepath.Join(path, "mutex.pprof")
-		f, err := os.Create(fn)
+		fn := p.modeFile(mode, "mutex.pprof")
+		f, err := p.create(mode, fn)
 		if err != nil {
-			log.Fatalf("profile: could not create mutex profile %q: %v", fn, err)
+			return nil, nil, fmt.Errorf("could not create mutex profile %q: %v", fn, err)
+		}
+		rate := p.mutexProfileFraction
+		if rate <= 0 {
+			rate = 1
 		}
-		runtime.SetMutexProfileFraction(1)
-		logf("profile: mutex profiling enabled, %s", fn)
-		prof.closer = func() {
-			if mp := pprof.Lookup("mutex"); mp != nil {
-				mp.WriteTo(f, 0)
+		prev := runtime.SetMutexProfileFraction(rate)
+		if p.resetOnFlush {
+			p.baseline("mutex")
+		}
+		p.enabled(mode, fn, rate)
+		flush = func() { p.snapshot(mode, fn) }
+		closer = func() {
+			if err := p.writeLookup(f, "mutex"); err != nil {
+				p.warnf("profile: could not write mutex profile %q: %v", fn, err)
 			}
-			f.Close()
-			runtime.SetMutexProfileFraction(0)
-			logf("profile: mutex profiling disabled, %s", fn)
+			p.close(f)
+			runtime.SetMutexProfileFraction(prev)
+			p.disabled(mode, fn)
 		}
 
 	case blockMode:
-		fn := filepath.Join(path, "block.pprof")
-		f, err := os.Create(fn)
+		fn := p.modeFile(mode, "block.pprof")
+		f, err := p.create(mode, fn)
 		if err != nil {
-			log.Fatalf("profile: could not create block profile %q: %v", fn, err)
+			return nil, nil, fmt.Errorf("could not create block profile %q: %v", fn, err)
 		}
-		runtime.SetBlockProfileRate(1)
-		logf("profile: block profiling enabled, %s", fn)
-		prof.closer = func() {
-			pprof.Lookup("block").WriteTo(f, 0)
-			f.Close()
+		rate := p.blockProfileRate
+		if rate <= 0 {
+			rate = 1
+		}
+		runtime.SetBlockProfileRate(rate)
+		if p.resetOnFlush {
+			p.baseline("block")
+		}
+		p.enabled(mode, fn, rate)
+		flush = func() { p.snapshot(mode, fn) }
+		closer = func() {
+			if err := p.writeLookup(f, "block"); err != nil {
+				p.warnf("profile: could not write block profile %q: %v", fn, err)
+			}
+			p.close(f)
 			runtime.SetBlockProfileRate(0)
-			logf("profile: block profiling disabled, %s", fn)
+			p.disabled(mode, fn)
 		}
 
 	case threadCreateMode:
-		fn := filepath.Join(path, "threadcreation.pprof")
-		f, err := os.Create(fn)
+		fn := p.modeFile(mode, "threadcreation.pprof")
+		f, err := p.create(mode, fn)
 		if err != nil {
-			log.Fatalf("profile: could not create thread creation profile %q: %v", fn, err)
+			return nil, nil, fmt.Errorf("could not create thread creation profile %q: %v", fn, err)
 		}
-		logf("profile: thread creation profiling enabled, %s", fn)
-		prof.closer = func() {
-			if mp := pprof.Lookup("threadcreate"); mp != nil {
-				mp.WriteTo(f, 0)
+		p.enabled(mode, fn, 0)
+		flush = func() { p.snapshot(mode, fn) }
+		closer = func() {
+			if err := p.writeLookup(f, "threadcreate"); err != nil {
+				p.warnf("profile: could not write thread creation profile %q: %v", fn, err)
 			}
-			f.Close()
-			logf("profile: thread creation profiling disabled, %s", fn)
+			p.close(f)
+			p.disabled(mode, fn)
 		}
 
 	case traceMode:
-		fn := filepath.Join(path, "trace.out")
-		f, err := os.Create(fn)
+		fn := p.traceFile(mode, p.modeFile(mode, "trace.out"))
+		f, err := p.create(mode, fn)
 		if err != nil {
-			log.Fatalf("profile: could not create trace output file %q: %v", fn, err)
+			return nil, nil, fmt.Errorf("could not create trace output file %q: %v", fn, err)
 		}
-		if err := trace.Start(f); err != nil {
-			log.Fatalf("profile: could not start trace: %v", err)
+		if err := trace.Start(p.writer(f)); err != nil {
+			p.discard(f)
+			if !p.isolated {
+				return nil, nil, fmt.Errorf("could not start trace: %v", err)
+			}
+			p.warnf("profile: could not start trace: %v", err)
+			return nil, nil, nil
 		}
-		logf("profile: trace enabled, %s", fn)
-		prof.closer = func() {
+		p.traceLog("start")
+		p.enabled(mode, fn, 0)
+		cur := fn
+		// stopped is set once the trace could not be restarted after
+		// a rotation, leaving nothing more to rotate or close.
+		stopped := false
+		flush = func() {
+			if stopped {
+				return
+			}
+			next := p.next(fn)
+			nf, err := p.create(mode, next)
+			if err != nil {
+				p.warnf("profile: could not create trace output file %q: %v", next, err)
+				return
+			}
 			trace.Stop()
-			logf("profile: trace disabled, %s", fn)
+			p.close(f)
+			if err := trace.Start(p.writer(nf)); err != nil {
+				p.discard(nf)
+				p.warnf("profile: could not restart trace, no longer tracing: %v", err)
+				stopped = true
+				return
+			}
+			f, cur = nf, next
+			p.logf("profile: trace rotated, %s", cur)
+		}
+		closer = func() {
+			if !stopped {
+				p.traceLog("stop")
+				trace.Stop()
+				p.close(f)
+			}
+			p.disabled(mode, cur)
+		}
+
+	case customMode:
+		name := p.customProfile
+		fn := p.modeFile(mode, sanitize(name)+".pprof")
+		f, err := p.create(mode, fn)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not create %s profile %q: %v", name, fn, err)
+		}
+		p.enabled(mode, fn, 0)
+		flush = func() { p.snapshot(mode, fn) }
+		closer = func() {
+			if err := p.writeLookup(f, name); err != nil {
+				p.warnf("profile: could not write %s profile %q: %v", name, fn, err)
+			}
+			p.close(f)
+			p.disabled(mode, fn)
 		}
 
 	case goroutineMode:
-		fn := filepath.Join(path, "goroutine.pprof")
-		f, err := os.Create(fn)
+		fn := p.modeFile(mode, "goroutine.pprof")
+		f, err := p.create(mode, fn)
 		if err != nil {
-			log.Fatalf("profile: could not create goroutine profile %q: %v", fn, err)
+			return nil, nil, fmt.Errorf("could not create goroutine profile %q: %v", fn, err)
 		}
-		logf("profile: goroutine profiling enabled, %s", fn)
-		prof.closer = func() {
-			if mp := pprof.Lookup("goroutine"); mp != nil {
-				mp.WriteTo(f, 0)
+		p.enabled(mode, fn, 0)
+		flush = func() { p.snapshot(mode, fn) }
+		closer = func() {
+			if err := p.writeLookup(f, "goroutine"); err != nil {
+				p.warnf("profile: could not write goroutine profile %q: %v", fn, err)
 			}
-			f.Close()
-			logf("profile: goroutine profiling disabled, %s", fn)
+			p.close(f)
+			p.disabled(mode, fn)
 		}
 
 	case clockMode:
-		fn := filepath.Join(path, "clock.pprof")
-		f, err := os.Create(fn)
+		fn := p.modeFile(mode, "clock.pprof")
+		f, err := p.create(mode, fn)
 		if err != nil {
-			log.Fatalf("profile: could not create clock profile %q: %v", fn, err)
+			return nil, nil, fmt.Errorf("could not create clock profile %q: %v", fn, err)
 		}
-		logf("profile: clock profiling enabled, %s", fn)
-		stop := fgprof.Start(f, fgprof.FormatPprof)
-		prof.closer = func() {
+		p.enabled(mode, fn, 0)
+		stop := fgprof.Start(p.writer(f), fgprof.FormatPprof)
+		cur := fn
+		chunks := []string{fn}
+		flush = func() {
+			next := p.next(fn)
+			nf, err := p.create(mode, next)
+			if err != nil {
+				p.warnf("profile: could not create clock profile %q: %v", next, err)
+				return
+			}
 			stop()
-			f.Close()
-			logf("profile: clock profiling disabled, %s", fn)
+			p.close(f)
+			f, cur = nf, next
+			chunks = append(chunks, cur)
+			stop = fgprof.Start(p.writer(f), fgprof.FormatPprof)
+			p.logf("profile: clock profile rotated, %s", cur)
+		}
+		closer = func() {
+			stop()
+			p.close(f)
+			p.disabled(mode, cur)
+			if p.mergeOnStop {
+				p.merge(chunks)
+			}
 		}
-	}
-
-	if !prof.noShutdownHook {
-		go func() {
-			c := make(chan os.Signal, 1)
-			signal.Notify(c, os.Interrupt)
-			<-c
 
-			log.Println("profile: caught interrupt, stopping profiles")
-			prof.Stop()
+	case flightMode:
+		fr, err := startFlight(p.flightWindow)
+		if err != nil {
+			p.warnf("profile: could not start flight recorder: %v", err)
+			return nil, nil, nil
+		}
+		p.flight = fr
+		fn := p.traceFile(mode, p.filename(p.baseName(mode, "flight.trace")))
+		p.enabled(mode, fn, 0)
+		flush = func() {
+			if _, err := p.snapshotFlight(); err != nil {
+				p.warnf("%v", err)
+			}
+		}
+		closer = func() {
+			fr.stop()
+			p.flight = nil
+			p.disabled(mode, fn)
+		}
 
-			os.Exit(0)
-		}()
+	case pmuMode:
+		fn := p.modeFile(mode, "pmu.pprof")
+		f, err := p.create(mode, fn)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not create pmu profile %q: %v", fn, err)
+		}
+		pp, err := startPMU(p.pmuEvent)
+		if err != nil {
+			p.discard(f)
+			p.warnf("profile: could not start pmu profile: %v", err)
+			return nil, nil, nil
+		}
+		p.enabled(mode, fn, 0)
+		closer = func() {
+			if err := pp.stop(f); err != nil {
+				p.warnf("profile: could not write pmu profile %q: %v", fn, err)
+			}
+			p.close(f)
+			p.disabled(mode, fn)
+		}
 	}
-
-	return &prof
+	return closer, flush, nil
 }
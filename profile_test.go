@@ -3,13 +3,25 @@ package profile
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+
+	pprofile "github.com/google/pprof/profile"
 )
 
 type checkFn func(t *testing.T, stdout, stderr []byte, err error)
@@ -21,6 +33,21 @@ func TestProfile(t *testing.T) {
 	}
 	defer os.Remove(f.Name())
 
+	root, err := ioutil.TempDir("", "profile_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	uploads := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case uploads <- r.Header.Get("X-Profile-Mode"):
+		default:
+		}
+	}))
+	defer srv.Close()
+
 	var profileTests = []struct {
 		name   string
 		code   string
@@ -73,6 +100,61 @@ func main() {
 			Stderr("profile: memory profiling enabled (rate 2048)"),
 			NoErr,
 		},
+	}, {
+		name: "memory profile (default rate 1024)",
+		code: `
+package main
+
+import "github.com/pkg/profile"
+
+func init() {
+	profile.DefaultMemProfileRate = 1024
+}
+
+func main() {
+	defer profile.Start(profile.MemProfile).Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: memory profiling enabled (rate 1024)"),
+			NoErr,
+		},
+	}, {
+		name: "memory profile allocs",
+		code: `
+package main
+
+import (
+	"io/ioutil"
+	"log"
+
+	pprofile "github.com/google/pprof/profile"
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/mem-allocs"
+	profile.Start(profile.MemProfileAllocs, profile.ProfilePath(dir)).Stop()
+	data, err := ioutil.ReadFile(dir + "/mem.pprof")
+	if err != nil {
+		log.Fatal(err)
+	}
+	prof, err := pprofile.ParseData(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if prof.DefaultSampleType != "alloc_space" {
+		log.Fatalf("want alloc_space as the default sample type, got %q", prof.DefaultSampleType)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: memory profiling enabled (rate 4096), "+filepath.Join(root, "mem-allocs", "mem.pprof"),
+				"profile: memory profiling disabled, "+filepath.Join(root, "mem-allocs", "mem.pprof")),
+			NoErr,
+		},
 	}, {
 		name: "double start",
 		code: `
@@ -95,79 +177,3493 @@ func main() {
 		code: `
 package main
 
-import "github.com/pkg/profile"
+import "github.com/pkg/profile"
+
+func main() {
+	defer profile.Start(profile.BlockProfile).Stop()
+}	
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: block profiling enabled"),
+			NoErr,
+		},
+	}, {
+		name: "mutex profile",
+		code: `
+package main
+
+import "github.com/pkg/profile"
+
+func main() {
+	defer profile.Start(profile.MutexProfile).Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: mutex profiling enabled"),
+			NoErr,
+		},
+	}, {
+		name: "mutex profile contention",
+		code: `
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"runtime"
+	"sync"
+
+	pprofile "github.com/google/pprof/profile"
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/mutex-contention"
+	p := profile.Start(profile.MutexProfile, profile.Quiet, profile.ProfilePath(dir))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				mu.Lock()
+				runtime.Gosched()
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	p.Stop()
+	if rate := runtime.SetMutexProfileFraction(-1); rate != 0 {
+		log.Fatalf("mutex profile fraction not restored, got %d", rate)
+	}
+	data, err := ioutil.ReadFile(dir + "/mutex.pprof")
+	if err != nil {
+		log.Fatal(err)
+	}
+	prof, err := pprofile.ParseData(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(prof.Sample) == 0 {
+		log.Fatal("no contention recorded in mutex profile")
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			NoErr,
+		},
+	}, {
+		name: "goroutine profile",
+		code: `
+package main
+
+import (
+	"io/ioutil"
+	"log"
+
+	pprofile "github.com/google/pprof/profile"
+	"github.com/pkg/profile"
+)
+
+func stuck(started chan struct{}) {
+	close(started)
+	select {}
+}
+
+func main() {
+	started := make(chan struct{})
+	go stuck(started)
+	<-started
+	dir := "` + root + `/goroutine-profile"
+	profile.Start(profile.GoroutineProfile, profile.ProfilePath(dir)).Stop()
+	data, err := ioutil.ReadFile(dir + "/goroutine.pprof")
+	if err != nil {
+		log.Fatal(err)
+	}
+	prof, err := pprofile.ParseData(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, fn := range prof.Function {
+		if fn.Name == "main.stuck" {
+			return
+		}
+	}
+	log.Fatal("stuck goroutine missing from goroutine profile")
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: goroutine profiling enabled, "+filepath.Join(root, "goroutine-profile", "goroutine.pprof"),
+				"profile: goroutine profiling disabled, "+filepath.Join(root, "goroutine-profile", "goroutine.pprof")),
+			NoErr,
+		},
+	}, {
+		name: "thread creation profile",
+		code: `
+package main
+
+import (
+	"io/ioutil"
+	"log"
+
+	pprofile "github.com/google/pprof/profile"
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/threadcreation-profile"
+	profile.Start(profile.ThreadcreationProfile, profile.ProfilePath(dir)).Stop()
+	data, err := ioutil.ReadFile(dir + "/threadcreation.pprof")
+	if err != nil {
+		log.Fatal(err)
+	}
+	prof, err := pprofile.ParseData(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(prof.SampleType) == 0 || prof.SampleType[0].Type != "threadcreate" {
+		log.Fatalf("unexpected sample types: %v", prof.SampleType)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: thread creation profiling enabled, "+filepath.Join(root, "threadcreation-profile", "threadcreation.pprof"),
+				"profile: thread creation profiling disabled, "+filepath.Join(root, "threadcreation-profile", "threadcreation.pprof")),
+			NoErr,
+		},
+	}, {
+		name: "clock profile",
+		code: `
+package main
+
+import "github.com/pkg/profile"
+
+func main() {
+	defer profile.Start(profile.ClockProfile).Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: clock profiling enabled"),
+			NoErr,
+		},
+	}, {
+		name: "compress over threshold",
+		code: `
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	over := "` + root + `/compress-over"
+	profile.Start(profile.TraceProfile, profile.CompressOver(0), profile.ProfilePath(over)).Stop()
+	f, err := os.Open(filepath.Join(over, "trace.out.gz"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("go 1.")) {
+		log.Fatalf("trace.out.gz: not a trace")
+	}
+	if _, err := os.Stat(filepath.Join(over, "trace.out")); !os.IsNotExist(err) {
+		log.Fatalf("trace.out left behind: %v", err)
+	}
+
+	under := "` + root + `/compress-under"
+	profile.Start(profile.TraceProfile, profile.CompressOver(1<<30), profile.ProfilePath(under), profile.Quiet).Stop()
+	if _, err := os.Stat(filepath.Join(under, "trace.out")); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(under, "trace.out.gz")); !os.IsNotExist(err) {
+		log.Fatalf("trace.out.gz written under the threshold: %v", err)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: trace enabled",
+				"profile: trace disabled",
+				"profile: compressed"),
+			NoErr,
+		},
+	}, {
+		name: "upload",
+		code: `
+package main
+
+import "github.com/pkg/profile"
+
+func main() {
+	defer profile.Start(profile.Upload("` + srv.URL + `")).Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: cpu profiling enabled",
+				"profile: cpu profiling disabled",
+				"profile: uploaded"),
+			NoErr,
+			func(t *testing.T, _, _ []byte, _ error) {
+				select {
+				case mode := <-uploads:
+					if mode != "cpu" {
+						t.Errorf("upload: wanted mode %q, got %q", "cpu", mode)
+					}
+				default:
+					t.Errorf("upload: no profile received")
+				}
+			},
+		},
+	}, {
+		name: "upload error",
+		code: `
+package main
+
+import "github.com/pkg/profile"
+
+func main() {
+	defer profile.Start(profile.Upload("http://127.0.0.1:1/")).Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: cpu profiling enabled",
+				"profile: cpu profiling disabled",
+				"profile: could not upload"),
+			NoErr,
+		},
+	}, {
+		name: "upload error warn verbosity",
+		code: `
+package main
+
+import "github.com/pkg/profile"
+
+func main() {
+	defer profile.Start(profile.Verbosity(profile.LevelWarn), profile.Upload("http://127.0.0.1:1/")).Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: could not upload"),
+			NoErr,
+		},
+	}, {
+		name: "upload error quiet",
+		code: `
+package main
+
+import "github.com/pkg/profile"
+
+func main() {
+	defer profile.Start(profile.Quiet, profile.Upload("http://127.0.0.1:1/")).Stop()
+}
+`,
+		checks: []checkFn{NoStdout, NoStderr, NoErr},
+	}, {
+		name: "filter labels",
+		code: `
+package main
+
+import (
+	"context"
+	"runtime/pprof"
+	"sync"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	defer profile.Start(profile.GoroutineProfile, profile.FilterLabels("tenant", "^a$")).Stop()
+	var wg sync.WaitGroup
+	block := make(chan struct{})
+	for _, tenant := range []string{"a", "b"} {
+		wg.Add(1)
+		go pprof.Do(context.Background(), pprof.Labels("tenant", tenant), func(context.Context) {
+			wg.Done()
+			<-block
+		})
+	}
+	wg.Wait()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: goroutine profiling enabled",
+				"profile: goroutine profiling disabled",
+				"by labels, kept 1 of"),
+			NoErr,
+		},
+	}, {
+		name: "results",
+		code: `
+package main
+
+import (
+	"log"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	p := profile.Start()
+	p.Stop()
+	r := p.Results()
+	if r.Start.IsZero() || r.End.Before(r.Start) {
+		log.Fatalf("unexpected profiling window: %v to %v", r.Start, r.End)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: cpu profiling enabled",
+				"profile: cpu profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "cgo hint",
+		code: `
+package main
+
+// static int add(int a, int b) { return a + b; }
+import "C"
+
+import "github.com/pkg/profile"
+
+func main() {
+	defer profile.Start(profile.CgoHint).Stop()
+	for i := 0; i < 100; i++ {
+		C.add(C.int(i), 1)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: cpu profiling enabled",
+				"profile: cpu profiling disabled",
+				"cgo calls were made while cpu profiling"),
+			NoErr,
+		},
+	}, {
+		name: "deterministic",
+		code: `
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	pprofile "github.com/google/pprof/profile"
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/deterministic"
+	profile.Start(profile.GoroutineProfile, profile.Deterministic, profile.ProfilePath(dir)).Stop()
+	f, err := os.Open(filepath.Join(dir, "goroutine.pprof"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	prof, err := pprofile.Parse(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if prof.TimeNanos != 0 || prof.DurationNanos != 0 {
+		log.Fatalf("time not cleared: %d, %d", prof.TimeNanos, prof.DurationNanos)
+	}
+	if len(prof.Sample) == 0 {
+		log.Fatal("no samples")
+	}
+	for i, l := range prof.Location {
+		if l.ID != uint64(i+1) {
+			log.Fatalf("location %d has ID %d", i, l.ID)
+		}
+	}
+	keys := make([]string, len(prof.Sample))
+	for i, s := range prof.Sample {
+		var b strings.Builder
+		for _, l := range s.Location {
+			fmt.Fprintf(&b, "%016x;", l.ID)
+		}
+		for _, v := range s.Value {
+			fmt.Fprintf(&b, "%020d;", v)
+		}
+		keys[i] = b.String()
+	}
+	if !sort.StringsAreSorted(keys) {
+		log.Fatalf("samples not sorted by stack")
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: goroutine profiling enabled",
+				"profile: goroutine profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "flush goroutine profile",
+		code: `
+package main
+
+import "github.com/pkg/profile"
+
+func main() {
+	p := profile.Start(profile.GoroutineProfile)
+	p.Flush()
+	p.Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: goroutine profiling enabled",
+				"profile: goroutine profile flushed",
+				"profile: goroutine profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "flush cpu profile",
+		code: `
+package main
+
+import "github.com/pkg/profile"
+
+func main() {
+	p := profile.Start(profile.CPUProfile)
+	p.Flush()
+	p.Stop()
+	p.Flush()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: cpu profiling enabled",
+				"profile: cpu profile rotated",
+				"profile: cpu profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "max bytes",
+		code: `
+package main
+
+import "github.com/pkg/profile"
+
+func main() {
+	defer profile.Start(profile.MaxBytes(1)).Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: cpu profiling enabled",
+				"limit of 1 bytes reached, stopping profiling",
+				"profile: cpu profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "max bytes stops trace",
+		code: `
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	p := profile.Start(profile.TraceProfile, profile.MaxBytes(1))
+	time.Sleep(500 * time.Millisecond)
+	if p.Results().End.IsZero() {
+		log.Fatal("trace was not stopped")
+	}
+	p.Stop()
+}
+`,
+		checks: []checkFn{NoStdout, NoErr},
+	}, {
+		name: "preallocate",
+		code: `
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir, err := ioutil.TempDir("", "profile-preallocate")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	profile.Start(profile.TraceProfile, profile.ProfilePath(dir), profile.Preallocate(1<<20)).Stop()
+	fi, err := os.Stat(filepath.Join(dir, "trace.out"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if fi.Size() == 0 || fi.Size() >= 1<<20 {
+		log.Fatalf("unexpected trace size %d", fi.Size())
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: trace enabled",
+				"profile: trace disabled"),
+			NoErr,
+		},
+	}, {
+		name: "merge on stop",
+		code: `
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	pprofile "github.com/google/pprof/profile"
+	"github.com/pkg/profile"
+)
+
+var sink int
+
+//go:noinline
+func spinA() { spin() }
+
+//go:noinline
+func spinB() { spin() }
+
+//go:noinline
+func spinC() { spin() }
+
+func spin() {
+	for end := time.Now().Add(300 * time.Millisecond); time.Now().Before(end); {
+		for i := 0; i < 1000; i++ {
+			sink += i
+		}
+	}
+}
+
+func main() {
+	dir := "` + root + `/merge-on-stop"
+	p := profile.Start(profile.CPUProfile, profile.MergeOnStop, profile.ProfilePath(dir))
+	spinA()
+	p.Flush()
+	spinB()
+	p.Flush()
+	spinC()
+	p.Stop()
+	for _, part := range []string{"cpu.1.pprof", "cpu.2.pprof"} {
+		if _, err := os.Stat(filepath.Join(dir, part)); !os.IsNotExist(err) {
+			log.Fatalf("%s not removed: %v", part, err)
+		}
+	}
+	f, err := os.Open(filepath.Join(dir, "cpu.pprof"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	prof, err := pprofile.Parse(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, s := range prof.Sample {
+		for _, l := range s.Location {
+			for _, ln := range l.Line {
+				if ln.Function != nil {
+					seen[ln.Function.Name] = true
+				}
+			}
+		}
+	}
+	for _, fn := range []string{"main.spinA", "main.spinB", "main.spinC"} {
+		if !seen[fn] {
+			log.Fatalf("merged profile has no samples of %s", fn)
+		}
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: cpu profiling enabled",
+				"profile: cpu profile rotated",
+				"profile: cpu profile rotated",
+				"profile: cpu profiling disabled",
+				"profile: merged 3 profiles"),
+			NoErr,
+		},
+	}, {
+		name: "reset on flush",
+		code: `
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	pprofile "github.com/google/pprof/profile"
+	"github.com/pkg/profile"
+)
+
+//go:noinline
+func blockA() { block() }
+
+//go:noinline
+func blockB() { block() }
+
+func block() {
+	c := make(chan struct{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(c)
+	}()
+	<-c
+}
+
+// blocked reports whether fn blocked in the block profile written to name.
+func blocked(name, fn string) bool {
+	f, err := os.Open(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	prof, err := pprofile.Parse(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, s := range prof.Sample {
+		if s.Value[0] == 0 {
+			continue
+		}
+		for _, l := range s.Location {
+			for _, ln := range l.Line {
+				if ln.Function != nil && ln.Function.Name == fn {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func main() {
+	dir := "` + root + `/reset-on-flush"
+	p := profile.Start(profile.BlockProfile, profile.ResetOnFlush, profile.ProfilePath(dir))
+	blockA()
+	p.Flush()
+	blockB()
+	p.Flush()
+	p.Stop()
+	first, second := filepath.Join(dir, "block.1.pprof"), filepath.Join(dir, "block.2.pprof")
+	if !blocked(first, "main.blockA") {
+		log.Fatalf("%s: blockA missing", first)
+	}
+	if !blocked(second, "main.blockB") {
+		log.Fatalf("%s: blockB missing", second)
+	}
+	if blocked(second, "main.blockA") {
+		log.Fatalf("%s: holds blockA from before the first flush", second)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: block profiling enabled",
+				"profile: block profile flushed",
+				"profile: block profile flushed",
+				"profile: block profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "auto name",
+		code: `
+package main
+
+import "github.com/pkg/profile"
+
+func main() {
+	defer profile.Start(profile.AutoName).Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: cpu profiling enabled",
+				"main-cpu.pprof"),
+			NoErr,
+		},
+	}, {
+		name: "sync",
+		code: `
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	pprofile "github.com/google/pprof/profile"
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/sync"
+	profile.Start(profile.MemProfile, profile.Sync, profile.ProfilePath(dir)).Stop()
+	f, err := os.Open(filepath.Join(dir, "mem.pprof"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if fi.Size() == 0 {
+		log.Fatal("mem.pprof is empty")
+	}
+	if _, err := pprofile.Parse(f); err != nil {
+		log.Fatalf("mem.pprof is incomplete: %v", err)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: memory profiling enabled",
+				"profile: memory profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "trace and cpu profile",
+		code: `
+package main
+
+import "github.com/pkg/profile"
+
+func main() {
+	defer profile.Start(profile.TraceProfile, profile.Also(profile.CPUProfile)).Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: trace enabled",
+				"profile: cpu profiling enabled",
+				"profile: cpu profiling disabled",
+				"profile: trace disabled"),
+			NoErr,
+		},
+	}, {
+		name: "json log",
+		code: `
+package main
+
+import (
+	"os"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	defer profile.Start(profile.MemProfileRate(2048), profile.JSONLog(os.Stderr)).Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr(`{"event":"start","mode":"mem","path":`,
+				`{"event":"stop","mode":"mem","path":`),
+			Stderr(`"rate":2048}`),
+			NoErr,
+		},
+	}, {
+		name: "json log quiet",
+		code: `
+package main
+
+import (
+	"os"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	defer profile.Start(profile.JSONLog(os.Stderr), profile.Quiet).Stop()
+}
+`,
+		checks: []checkFn{NoStdout, NoStderr, NoErr},
+	}, {
+		name: "tee",
+		code: `
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+
+	"github.com/pkg/profile"
+)
+
+type broken struct{}
+
+func (broken) Write([]byte) (int, error) { return 0, errors.New("broken pipe") }
+
+func main() {
+	var buf bytes.Buffer
+	profile.Start(profile.Tee(broken{}, &buf)).Stop()
+	if buf.Len() == 0 {
+		log.Fatal("nothing written to tee destination")
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: cpu profiling enabled",
+				"profile: could not write to tee destination 0, dropping it: broken pipe",
+				"profile: cpu profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "cpu profile rate",
+		code: `
+package main
+
+import "github.com/pkg/profile"
+
+func main() {
+	defer profile.Start(profile.CPUProfileRate(500)).Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: cpu profiling enabled",
+				"profile: cpu profile rate set to 500 Hz, a runtime warning that it cannot set the rate refers to its default and is harmless",
+				"runtime: cannot set cpu profile rate until previous profile has finished",
+				"profile: cpu profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "invalid cpu profile rate",
+		code: `
+package main
+
+import "github.com/pkg/profile"
+
+func main() {
+	defer profile.Start(profile.CPUProfileRate(0)).Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: invalid cpu profile rate 0 Hz, must be between 1 and 10000"),
+			Err,
+		},
+	}, {
+		name: "text report",
+		code: `
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/profile"
+)
+
+var sink []byte
+
+func main() {
+	p := profile.Start(profile.MemProfile, profile.TextReport, profile.ProfilePath("` + root + `/report"))
+	for i := 0; i < 1000; i++ {
+		sink = make([]byte, 64<<10)
+	}
+	p.Stop()
+	report, err := ioutil.ReadFile(filepath.Join("` + root + `", "report", "report.txt"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !strings.Contains(string(report), "main.main") {
+		log.Fatalf("main.main missing from report:\n%s", report)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: memory profiling enabled",
+				"profile: memory profiling disabled",
+				"profile: text report written to"),
+			NoErr,
+		},
+	}, {
+		name: "mem both views",
+		code: `
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/profile"
+)
+
+var sink []byte
+
+func main() {
+	p := profile.Start(profile.MemProfile, profile.MemBothViews, profile.ProfilePath("` + root + `/views"))
+	for i := 0; i < 1000; i++ {
+		sink = make([]byte, 64<<10)
+	}
+	p.Stop()
+	for _, view := range []string{"inuse_space", "alloc_space"} {
+		report, err := ioutil.ReadFile(filepath.Join("` + root + `", "views", "mem-"+view+".txt"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !strings.Contains(string(report), "Type: "+view) || !strings.Contains(string(report), "main.main") {
+			log.Fatalf("unexpected %s report:\n%s", view, report)
+		}
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: memory profiling enabled",
+				"profile: memory profiling disabled",
+				"profile: inuse_space report written to",
+				"profile: alloc_space report written to"),
+			NoErr,
+		},
+	}, {
+		name: "stop from another goroutine",
+		code: `
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+
+	pprofile "github.com/google/pprof/profile"
+	"github.com/pkg/profile"
+)
+
+func main() {
+	p := profile.Start(profile.MemProfile, profile.ProfilePath("` + root + `/watchdog"))
+	errc := make(chan error)
+	go func() { errc <- p.StopAndWait() }()
+	p.Stop()
+	data, err := ioutil.ReadFile(filepath.Join("` + root + `", "watchdog", "mem.pprof"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := pprofile.ParseData(data); err != nil {
+		log.Fatalf("incomplete profile after Stop: %v", err)
+	}
+	if err := <-errc; err != nil {
+		log.Fatal(err)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: memory profiling enabled",
+				"profile: memory profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "gc percent",
+		code: `
+package main
+
+import (
+	"log"
+	"runtime/debug"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	debug.SetGCPercent(150)
+	p := profile.Start(profile.MemProfile, profile.GCPercent(10))
+	if pct := debug.SetGCPercent(10); pct != 10 {
+		log.Fatalf("gc percent during profiling: want 10, got %d", pct)
+	}
+	p.Stop()
+	if pct := debug.SetGCPercent(150); pct != 150 {
+		log.Fatalf("gc percent after profiling: want 150, got %d", pct)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: gc percent set to 10",
+				"profile: memory profiling enabled",
+				"profile: memory profiling disabled",
+				"profile: gc percent restored to 150"),
+			NoErr,
+		},
+	}, {
+		name: "tar writer",
+		code: `
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	var buf bytes.Buffer
+	dir := "` + root + `/tar"
+	profile.Start(profile.CPUProfile, profile.Also(profile.MemProfile), profile.TarWriter(&buf), profile.ProfilePath(dir)).Stop()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		log.Fatalf("output directory created: %v", err)
+	}
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if hdr.Size == 0 {
+			log.Fatalf("empty tar entry %s", hdr.Name)
+		}
+		names = append(names, hdr.Name)
+	}
+	if got := strings.Join(names, " "); got != "cpu.pprof mem.pprof" {
+		log.Fatalf("tar entries: want cpu.pprof mem.pprof, got %s", got)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: cpu profiling enabled",
+				"profile: memory profiling enabled",
+				"profile: memory profiling disabled",
+				"profile: cpu profiling disabled",
+				"profile: profiles written to tar stream"),
+			NoErr,
+		},
+	}, {
+		name: "profile on signal",
+		code: `
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/signal"
+	p := profile.Start(profile.ProfileOnSignal(syscall.SIGUSR2, profile.MemProfile, 50*time.Millisecond), profile.ProfilePath(dir))
+	syscall.Kill(os.Getpid(), syscall.SIGUSR2)
+	time.Sleep(500 * time.Millisecond)
+	p.Stop()
+	files, err := filepath.Glob(filepath.Join(dir, "signal-*", "mem.signal.pprof"))
+	if err != nil || len(files) != 1 {
+		log.Fatalf("want one capture, got %v: %v", files, err)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: profiling on user defined signal 2",
+				"profile: user defined signal 2 received, profiling for 50ms",
+				"profile: memory profiling enabled",
+				"profile: memory profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "profile on signal start error",
+		code: `
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/signal-error"
+	p := profile.Start(profile.ProfileOnSignal(syscall.SIGUSR2, profile.CustomProfile("unregistered"), 50*time.Millisecond), profile.ProfilePath(dir))
+	syscall.Kill(os.Getpid(), syscall.SIGUSR2)
+	time.Sleep(500 * time.Millisecond)
+	p.Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: profiling on user defined signal 2",
+				"profile: user defined signal 2 received, profiling for 50ms",
+				`profile: could not start capture on user defined signal 2: no profile named "unregistered" is registered`),
+			NoErr,
+		},
+	}, {
+		name: "reason",
+		code: `
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/reason"
+	profile.Start(profile.MemProfile, profile.AutoName, profile.Reason("high rss"), profile.ProfilePath(dir)).Stop()
+	if _, err := os.Stat(filepath.Join(dir, filepath.Base(os.Args[0])+"-mem.high_rss.pprof")); err != nil {
+		log.Fatal(err)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: memory profiling enabled",
+				"profile: memory profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "index html",
+		code: `
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/index"
+	profile.Start(profile.TraceProfile, profile.Also(profile.MemProfile), profile.IndexHTML, profile.ProfilePath(dir)).Stop()
+	page, err := ioutil.ReadFile(dir + "/index.html")
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, want := range []string{"<code>go tool trace trace.out</code>", "<code>go tool pprof -http=:0 mem.pprof</code>"} {
+		if !strings.Contains(string(page), want) {
+			log.Fatalf("%s missing from index:\n%s", want, page)
+		}
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: trace enabled",
+				"profile: memory profiling enabled",
+				"profile: memory profiling disabled",
+				"profile: trace disabled",
+				"profile: index written to "+filepath.Join(root, "index", "index.html")),
+			NoErr,
+		},
+	}, {
+		name: "overhead stats",
+		code: `
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/overhead"
+	p := profile.Start(profile.MemProfile, profile.OverheadStats, profile.ProfilePath(dir))
+	p.Stop()
+	o := p.Results().Overhead
+	if o == nil || o.Start <= 0 || o.Stop <= 0 {
+		log.Fatalf("unexpected overhead %+v", o)
+	}
+	stats, err := ioutil.ReadFile(dir + "/overhead.txt")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !strings.Contains(string(stats), "Stop: "+o.Stop.String()) {
+		log.Fatalf("unexpected overhead.txt:\n%s", stats)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: memory profiling enabled",
+				"profile: memory profiling disabled",
+				"profile: overhead written to "+filepath.Join(root, "overhead", "overhead.txt")),
+			NoErr,
+		},
+	}, {
+		name: "signal action flush and continue",
+		code: `
+package main
+
+import (
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/signal-action"
+	p := profile.Start(profile.MemProfile, profile.ShutdownHook, profile.SignalAction(profile.FlushAndContinue), profile.ProfilePath(dir))
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+		time.Sleep(50 * time.Millisecond)
+	}
+	p.Stop()
+	for _, fn := range []string{"mem.1.pprof", "mem.2.pprof", "mem.pprof"} {
+		if _, err := os.Stat(dir + "/" + fn); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: memory profiling enabled",
+				"profile: caught interrupt, flushing profiles",
+				"profile: heap profile flushed",
+				"profile: caught interrupt, flushing profiles",
+				"profile: heap profile flushed",
+				"profile: memory profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "latest symlink",
+		code: `
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/latest"
+	p := profile.Start(profile.CPUProfile, profile.Also(profile.MemProfile), profile.LatestSymlink, profile.ProfilePath(dir))
+	p.Flush()
+	p.Stop()
+	for link, want := range map[string]string{"cpu-latest.pprof": "cpu.1.pprof", "mem-latest.pprof": "mem.pprof"} {
+		got, err := os.Readlink(dir + "/" + link)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if got != want {
+			log.Fatalf("%s: want link to %s, got %s", link, want, got)
+		}
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			NoErr,
+		},
+	}, {
+		name: "run",
+		code: `
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/pkg/profile"
+)
+
+var sink []byte
+
+func main() {
+	dir := "` + root + `/run"
+	profile.Run(func() {
+		sink = make([]byte, 1<<20)
+	}, profile.MemProfile, profile.ProfilePath(dir))
+	if _, err := os.Stat(dir + "/mem.pprof"); err != nil {
+		log.Fatal(err)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: memory profiling enabled",
+				"profile: memory profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "omit empty",
+		code: `
+package main
+
+import (
+	"log"
+	"os"
+	"runtime/pprof"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	// the runtime may record contention on its own locks in the
+	// mutex profile, so a custom profile is used as the empty one.
+	pprof.NewProfile("empty")
+	dir := "` + root + `/omit-empty"
+	profile.Start(profile.CustomProfile("empty"), profile.Also(profile.GoroutineProfile), profile.OmitEmpty, profile.ProfilePath(dir)).Stop()
+	if _, err := os.Stat(dir + "/empty.pprof"); !os.IsNotExist(err) {
+		log.Fatalf("empty profile written: %v", err)
+	}
+	if _, err := os.Stat(dir + "/goroutine.pprof"); err != nil {
+		log.Fatal(err)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: custom profiling enabled",
+				"profile: goroutine profiling enabled",
+				"profile: goroutine profiling disabled",
+				"profile: custom profiling disabled",
+				"profile: "+filepath.Join(root, "omit-empty", "empty.pprof")+" has no samples, removed"),
+			NoErr,
+		},
+	}, {
+		name: "custom profile",
+		code: `
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"runtime/pprof"
+
+	pprofile "github.com/google/pprof/profile"
+	"github.com/pkg/profile"
+)
+
+var openFiles = pprof.NewProfile("example.com/openfiles")
+
+func main() {
+	dir := "` + root + `/custom"
+	openFiles.Add("config", 0)
+	profile.Start(profile.CustomProfile("example.com/openfiles"), profile.ProfilePath(dir)).Stop()
+	data, err := ioutil.ReadFile(dir + "/example.com_openfiles.pprof")
+	if err != nil {
+		log.Fatal(err)
+	}
+	prof, err := pprofile.ParseData(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(prof.Sample) != 1 {
+		log.Fatalf("want 1 sample, got %d", len(prof.Sample))
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: custom profiling enabled",
+				"profile: custom profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "custom profile not registered",
+		code: `
+package main
+
+import "github.com/pkg/profile"
+
+func main() {
+	profile.Start(profile.CustomProfile("missing")).Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr(`profile: no profile named "missing" is registered`),
+			Err,
+		},
+	}, {
+		name: "heap delta",
+		code: `
+package main
+
+import (
+	"io/ioutil"
+	"log"
+
+	pprofile "github.com/google/pprof/profile"
+	"github.com/pkg/profile"
+)
+
+var leak [][]byte
+
+func main() {
+	dir := "` + root + `/heap-delta"
+	p := profile.Start(profile.HeapDelta, profile.ProfilePath(dir))
+	for i := 0; i < 100; i++ {
+		leak = append(leak, make([]byte, 64<<10))
+	}
+	p.Stop()
+	data, err := ioutil.ReadFile(dir + "/mem-delta.pprof")
+	if err != nil {
+		log.Fatal(err)
+	}
+	prof, err := pprofile.ParseData(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	idx := -1
+	for i, st := range prof.SampleType {
+		if st.Type == "inuse_space" {
+			idx = i
+		}
+	}
+	var growth int64
+	for _, s := range prof.Sample {
+		growth += s.Value[idx]
+	}
+	if growth < 4<<20 {
+		log.Fatalf("want at least 4MB of heap growth, got %d", growth)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: memory profiling enabled",
+				"profile: heap delta written to "+filepath.Join(root, "heap-delta", "mem-delta.pprof"),
+				"profile: memory profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "rotation",
+		code: `
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/rotation"
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		log.Fatal(err)
+	}
+	now := time.Now()
+	for i, age := range map[string]time.Duration{
+		"cpu.1.pprof": 3 * time.Hour,
+		"cpu.2.pprof": 2 * time.Hour,
+		"cpu.3.pprof": time.Hour,
+		"mem.pprof":   40 * 24 * time.Hour,
+	} {
+		fn := dir + "/" + i
+		if err := ioutil.WriteFile(fn, nil, 0666); err != nil {
+			log.Fatal(err)
+		}
+		if err := os.Chtimes(fn, now.Add(-age), now.Add(-age)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	profile.Start(profile.CPUProfile, profile.Rotation(0, 1, 30), profile.ProfilePath(dir)).Stop()
+	for _, fn := range []string{"cpu.pprof", "cpu.3.pprof"} {
+		if _, err := os.Stat(dir + "/" + fn); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: removed "+filepath.Join(root, "rotation", "cpu.1.pprof"),
+				"profile: removed "+filepath.Join(root, "rotation", "mem.pprof"),
+				"profile: cpu profiling enabled, "+filepath.Join(root, "rotation", "cpu.pprof"),
+				"profile: cpu profiling disabled, "+filepath.Join(root, "rotation", "cpu.pprof"),
+				"profile: removed "+filepath.Join(root, "rotation", "cpu.2.pprof")),
+			NoErr,
+		},
+	}, {
+		name: "flamegraph",
+		code: `
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+
+	"github.com/pkg/profile"
+)
+
+var sink [][]byte
+
+func main() {
+	dir := "` + root + `/flamegraph"
+	p := profile.Start(profile.MemProfileRate(1), profile.Flamegraph, profile.ProfilePath(dir))
+	for i := 0; i < 100; i++ {
+		sink = append(sink, make([]byte, 1<<10))
+	}
+	p.Stop()
+	svg, err := ioutil.ReadFile(dir + "/flame.svg")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !bytes.Contains(svg, []byte("main.main")) {
+		log.Fatalf("main.main not drawn in flame graph:\n%s", svg)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: memory profiling enabled (rate 1), "+filepath.Join(root, "flamegraph", "mem.pprof"),
+				"profile: memory profiling disabled, "+filepath.Join(root, "flamegraph", "mem.pprof"),
+				"profile: flame graph written to "+filepath.Join(root, "flamegraph", "flame.svg")),
+			NoErr,
+		},
+	}, {
+		name: "dir policy fail",
+		code: `
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/dir-policy-fail"
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/cpu.pprof", nil, 0666); err != nil {
+		log.Fatal(err)
+	}
+	profile.Start(profile.DirPolicy(profile.Fail), profile.ProfilePath(dir)).Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: \"" + filepath.Join(root, "dir-policy-fail") + "\" already holds profiles, e.g. cpu.pprof"),
+			Err,
+		},
+	}, {
+		name: "dir policy number",
+		code: `
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/dir-policy-number"
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/cpu.pprof", nil, 0666); err != nil {
+		log.Fatal(err)
+	}
+	profile.Start(profile.DirPolicy(profile.Number), profile.ProfilePath(dir)).Stop()
+	if fi, err := os.Stat(dir + "/cpu.pprof"); err != nil || fi.Size() != 0 {
+		log.Fatalf("cpu.pprof overwritten: %v", err)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: cpu profiling enabled, "+filepath.Join(root, "dir-policy-number", "cpu.1.pprof"),
+				"profile: cpu profiling disabled, "+filepath.Join(root, "dir-policy-number", "cpu.1.pprof")),
+			NoErr,
+		},
+	}, {
+		name: "dir policy clean",
+		code: `
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/dir-policy-clean"
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		log.Fatal(err)
+	}
+	for _, fn := range []string{"mem.pprof", "notes.txt"} {
+		if err := ioutil.WriteFile(dir+"/"+fn, nil, 0666); err != nil {
+			log.Fatal(err)
+		}
+	}
+	profile.Start(profile.DirPolicy(profile.Clean), profile.ProfilePath(dir)).Stop()
+	if _, err := os.Stat(dir + "/mem.pprof"); !os.IsNotExist(err) {
+		log.Fatalf("mem.pprof not removed: %v", err)
+	}
+	if _, err := os.Stat(dir + "/notes.txt"); err != nil {
+		log.Fatal(err)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: removed "+filepath.Join(root, "dir-policy-clean", "mem.pprof"),
+				"profile: cpu profiling enabled, "+filepath.Join(root, "dir-policy-clean", "cpu.pprof"),
+				"profile: cpu profiling disabled, "+filepath.Join(root, "dir-policy-clean", "cpu.pprof")),
+			NoErr,
+		},
+	}, {
+		name: "dir policy clean insufficient space",
+		code: `
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/dir-policy-clean-space"
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/mem.pprof", nil, 0666); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := profile.StartErr(profile.DirPolicy(profile.Clean), profile.MinFreeSpace(1<<62), profile.ProfilePath(dir)); err == nil {
+		log.Fatal("StartErr: wanted insufficient free space")
+	}
+	if _, err := os.Stat(dir + "/mem.pprof"); err != nil {
+		log.Fatalf("mem.pprof removed by a session which did not start: %v", err)
+	}
+}
+`,
+		checks: []checkFn{NoStdout, NoStderr, NoErr},
+	}, {
+		name: "record duration",
+		code: `
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"time"
+
+	pprofile "github.com/google/pprof/profile"
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/record-duration"
+	p := profile.Start(profile.BlockProfile, profile.RecordDuration, profile.ProfilePath(dir))
+	time.Sleep(100 * time.Millisecond)
+	p.Stop()
+	data, err := ioutil.ReadFile(dir + "/block.pprof")
+	if err != nil {
+		log.Fatal(err)
+	}
+	prof, err := pprofile.ParseData(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if d := time.Duration(prof.DurationNanos); d < 100*time.Millisecond {
+		log.Fatalf("want a duration of at least 100ms, got %v", d)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: block profiling enabled, "+filepath.Join(root, "record-duration", "block.pprof"),
+				"profile: block profiling disabled, "+filepath.Join(root, "record-duration", "block.pprof")),
+			NoErr,
+		},
+	}, {
+		name: "lazy",
+		code: `
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/lazy"
+	p := profile.Start(profile.Lazy, profile.MemProfile, profile.ProfilePath(dir))
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		log.Fatalf("lazy session created its directory: %v", err)
+	}
+	profile.Start(profile.CPUProfile, profile.ProfilePath(dir)).Stop()
+	p.Begin()
+	p.Stop()
+	p.Begin()
+	profile.Start(profile.Lazy, profile.ProfilePath(dir+"/never")).Stop()
+	if _, err := os.Stat(dir + "/never"); !os.IsNotExist(err) {
+		log.Fatalf("stopped lazy session created its directory: %v", err)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: cpu profiling enabled, "+filepath.Join(root, "lazy", "cpu.pprof"),
+				"profile: cpu profiling disabled, "+filepath.Join(root, "lazy", "cpu.pprof"),
+				"profile: memory profiling enabled (rate 4096), "+filepath.Join(root, "lazy", "mem.pprof"),
+				"profile: memory profiling disabled, "+filepath.Join(root, "lazy", "mem.pprof")),
+			NoErr,
+		},
+	}, {
+		name: "max sessions",
+		code: `
+package main
+
+import (
+	"github.com/pkg/profile"
+)
+
+func main() {
+	profile.MaxSessions(2)
+	for i := 0; i < 3; i++ {
+		profile.Start(profile.MemProfile, profile.ProfilePath("` + root + `/max-sessions")).Stop()
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: memory profiling enabled (rate 4096), "+filepath.Join(root, "max-sessions", "mem.pprof"),
+				"profile: memory profiling disabled, "+filepath.Join(root, "max-sessions", "mem.pprof"),
+				"profile: memory profiling enabled (rate 4096), "+filepath.Join(root, "max-sessions", "mem.pprof"),
+				"profile: memory profiling disabled, "+filepath.Join(root, "max-sessions", "mem.pprof"),
+				"profile: limit of 2 sessions reached, profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "folded stacks",
+		code: `
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+
+	"github.com/pkg/profile"
+)
+
+var sink [][]byte
+
+func main() {
+	dir := "` + root + `/folded-stacks"
+	p := profile.Start(profile.MemProfileRate(1), profile.FoldedStacks, profile.ProfilePath(dir))
+	for i := 0; i < 100; i++ {
+		sink = append(sink, make([]byte, 1<<10))
+	}
+	p.Stop()
+	folded, err := ioutil.ReadFile(dir + "/mem.folded")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !bytes.Contains(folded, []byte(";main.main")) {
+		log.Fatalf("main.main not in folded stacks:\n%s", folded)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: memory profiling enabled (rate 1), "+filepath.Join(root, "folded-stacks", "mem.pprof"),
+				"profile: memory profiling disabled, "+filepath.Join(root, "folded-stacks", "mem.pprof"),
+				"profile: folded stacks written to "+filepath.Join(root, "folded-stacks", "mem.folded")),
+			NoErr,
+		},
+	}, {
+		name: "correlation id",
+		code: `
+package main
+
+import (
+	"io/ioutil"
+	"log"
+
+	pprofile "github.com/google/pprof/profile"
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/correlation-id"
+	profile.Start(profile.MemProfile, profile.CorrelationID("incident 7"), profile.Reason("panic"), profile.Quiet, profile.ProfilePath(dir)).Stop()
+	data, err := ioutil.ReadFile(dir + "/incident_7-mem.panic.pprof")
+	if err != nil {
+		log.Fatal(err)
+	}
+	prof, err := pprofile.ParseData(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(prof.Comments) != 1 || prof.Comments[0] != "correlation id: incident 7" {
+		log.Fatalf("unexpected comments: %q", prof.Comments)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			NoErr,
+		},
+	}, {
+		name: "disable under pressure",
+		code: `
+package main
+
+import (
+	"log"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/pkg/profile"
+)
+
+var sink []byte
+
+func main() {
+	dir := "` + root + `/disable-under-pressure"
+	profile.Start(profile.MemProfile, profile.DisableUnderPressure(1), profile.ProfilePath(dir)).Stop()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	p := profile.Start(profile.MemProfile, profile.DisableUnderPressure(ms.HeapAlloc+32<<20), profile.ProfilePath(dir))
+	sink = make([]byte, 64<<20)
+	// the profile is written once the session stops.
+	written := func() bool {
+		fi, err := os.Stat(dir + "/mem.pprof")
+		return err == nil && fi.Size() > 0
+	}
+	for i := 0; i < 50 && !written(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !written() {
+		log.Fatal("session not stopped under pressure")
+	}
+	p.Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("bytes reached limit of 1 bytes, profiling disabled",
+				"profile: memory profiling enabled (rate 4096), "+filepath.Join(root, "disable-under-pressure", "mem.pprof"),
+				"bytes, stopping profiling",
+				"profile: memory profiling disabled, "+filepath.Join(root, "disable-under-pressure", "mem.pprof")),
+			NoErr,
+		},
+	}, {
+		name: "logger",
+		code: `
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	l := log.New(os.Stderr, "app: ", 0)
+	profile.Start(profile.MemProfile, profile.Logger(l), profile.ProfilePath("` + root + `/logger")).Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("app: profile: memory profiling enabled (rate 4096), "+filepath.Join(root, "logger", "mem.pprof"),
+				"app: profile: memory profiling disabled, "+filepath.Join(root, "logger", "mem.pprof")),
+			NoErr,
+		},
+	}, {
+		name: "write to",
+		code: `
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+
+	pprofile "github.com/google/pprof/profile"
+	"github.com/pkg/profile"
+)
+
+func main() {
+	var buf bytes.Buffer
+	root := "` + root + `/write-to"
+	profile.Start(profile.MemProfile, profile.WriteTo(profile.MemProfile, &buf), profile.TempRoot(root)).Stop()
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		log.Fatalf("output directory created: %v", err)
+	}
+	prof, err := pprofile.Parse(&buf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(prof.SampleType) == 0 || prof.SampleType[0].Type != "alloc_objects" {
+		log.Fatalf("unexpected sample types: %v", prof.SampleType)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: memory profiling enabled (rate 4096), mem.pprof",
+				"profile: memory profiling disabled, mem.pprof"),
+			NoErr,
+		},
+	}, {
+		name: "compress",
+		code: `
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/compress"
+	profile.Start(profile.TraceProfile, profile.Compress, profile.ProfilePath(dir)).Stop()
+	if _, err := os.Stat(filepath.Join(dir, "trace.out")); !os.IsNotExist(err) {
+		log.Fatalf("uncompressed trace written: %v", err)
+	}
+	f, err := os.Open(filepath.Join(dir, "trace.out.gz"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("go 1.")) {
+		log.Fatal("missing trace header")
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: trace enabled, ",
+				"profile: trace disabled, "),
+			Stderr("trace.out.gz"),
+			NoErr,
+		},
+	}, {
+		name: "compressor",
+		code: `
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/compressor"
+	zz := func(w io.Writer) (io.WriteCloser, error) { return zlib.NewWriter(w), nil }
+	profile.Start(profile.TraceProfile, profile.Compressor("zz", zz), profile.ProfilePath(dir), profile.Verify).Stop()
+	f, err := os.Open(filepath.Join(dir, "trace.out.zz"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	r, err := zlib.NewReader(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("go 1.")) {
+		log.Fatal("missing trace header")
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: trace enabled, ",
+				"profile: trace disabled, "),
+			Stderr("trace.out.zz"),
+			NoErr,
+		},
+	}, {
+		name: "filename template",
+		code: `
+package main
+
+import "github.com/pkg/profile"
+
+func main() {
+	defer profile.Start(profile.FilenameTemplate("{{.Name}}-{{.Time}}{{.Ext}}")).Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: cpu profiling enabled, ",
+				"profile: cpu profiling disabled, "),
+			Stderr("Z.pprof"),
+			NoErr,
+		},
+	}, {
+		name: "profile name",
+		code: `
+package main
+
+import "github.com/pkg/profile"
+
+func main() {
+	defer profile.Start(profile.ProfileName(profile.MemProfile, "api-mem.pprof"), profile.MemProfile).Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: memory profiling enabled (rate 4096), ",
+				"profile: memory profiling disabled, "),
+			Stderr("api-mem.pprof"),
+			NoErr,
+		},
+	}, {
+		name: "permissions",
+		code: `
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/permissions"
+	profile.Start(profile.ProfilePath(dir), profile.Permissions(0700, 0600), profile.Quiet).Stop()
+	for name, want := range map[string]os.FileMode{dir: 0700, filepath.Join(dir, "cpu.pprof"): 0600} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if got := fi.Mode().Perm(); got != want {
+			log.Fatalf("%s: want mode %v, got %v", name, want, got)
+		}
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			NoErr,
+		},
+	}, {
+		name: "atomic writes",
+		code: `
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/atomic-writes"
+	p := profile.Start(profile.AtomicWrites, profile.ProfilePath(dir), profile.Comment("atomic"), profile.Quiet)
+	if _, err := os.Stat(filepath.Join(dir, "cpu.pprof")); !os.IsNotExist(err) {
+		log.Fatalf("cpu.pprof visible while profiling: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".cpu.pprof.tmp")); err != nil {
+		log.Fatal(err)
+	}
+	p.Stop()
+	if _, err := os.Stat(filepath.Join(dir, "cpu.pprof")); err != nil {
+		log.Fatal(err)
+	}
+	tmp, err := filepath.Glob(filepath.Join(dir, ".*.tmp"))
+	if err != nil || len(tmp) > 0 {
+		log.Fatalf("temporary files left: %v %v", tmp, err)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			NoErr,
+		},
+	}, {
+		name: "duration",
+		code: `
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	p := profile.Start(profile.MemProfile, profile.Duration(100*time.Millisecond))
+	time.Sleep(time.Second)
+	p.Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: memory profiling enabled",
+				"profile: duration of 100ms elapsed, stopping profiling",
+				"profile: memory profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "delay",
+		code: `
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/delay"
+	p := profile.Start(profile.MemProfile, profile.Delay(200*time.Millisecond), profile.ProfilePath(dir))
+	if _, err := os.Stat(dir + "/mem.pprof"); !os.IsNotExist(err) {
+		log.Fatalf("profiling began before the delay: %v", err)
+	}
+	time.Sleep(time.Second)
+	p.Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: waiting 200ms before profiling",
+				"profile: memory profiling enabled",
+				"profile: memory profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "delay create error",
+		code: `
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/delay-error"
+	p := profile.Start(profile.MemProfile, profile.Delay(200*time.Millisecond), profile.ProfilePath(dir))
+	// replace the output directory with a file, so that the profile
+	// cannot be created once the delay has passed.
+	if err := os.RemoveAll(dir); err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir, nil, 0644); err != nil {
+		log.Fatal(err)
+	}
+	time.Sleep(time.Second)
+	if _, err := p.StopErr(); err == nil {
+		log.Fatal("StopErr: wanted the failure to begin profiling")
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: waiting 200ms before profiling",
+				"profile: could not begin profiling: could not create memory profile"),
+			NoErr,
+		},
+	}, {
+		name: "continuous cpu",
+		code: `
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	pprofile "github.com/google/pprof/profile"
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/continuous-cpu"
+	p := profile.Start(profile.Continuous(200*time.Millisecond, 2), profile.ContinuousCPU, profile.ProfilePath(dir), profile.Quiet)
+	time.Sleep(time.Second + 100*time.Millisecond)
+	p.Stop()
+	if _, err := os.Stat(filepath.Join(dir, "cpu.pprof")); !os.IsNotExist(err) {
+		log.Fatalf("cpu.pprof written: %v", err)
+	}
+	windows, err := filepath.Glob(filepath.Join(dir, "cpu-*.pprof"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(windows) != 3 {
+		log.Fatalf("wanted 2 complete windows and the last, got %q", windows)
+	}
+	for _, fn := range windows {
+		f, err := os.Open(fn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err := pprofile.Parse(f); err != nil {
+			log.Fatalf("%s: %v", fn, err)
+		}
+		f.Close()
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			NoErr,
+		},
+	}, {
+		name: "continuous cpu flush",
+		code: `
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/continuous-cpu-flush"
+	p := profile.Start(profile.Continuous(time.Hour, 1), profile.ContinuousCPU, profile.ProfilePath(dir), profile.Quiet)
+	for i := 0; i < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+		p.Flush()
+	}
+	p.Stop()
+	numbered, err := filepath.Glob(filepath.Join(dir, "cpu-*Z.*.pprof"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(numbered) != 0 {
+		log.Fatalf("flush wrote numbered windows: %q", numbered)
+	}
+	windows, err := filepath.Glob(filepath.Join(dir, "cpu-*.pprof"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(windows) != 2 {
+		log.Fatalf("wanted 1 kept window and the last, got %q", windows)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			NoErr,
+		},
+	}, {
+		name: "max files and age",
+		code: `
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/max-files"
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		log.Fatal(err)
+	}
+	now := time.Now()
+	for i, name := range []string{"heap-1.pprof", "heap-2.pprof", "heap-3.pprof", "trace.out", "notes.txt"} {
+		fn := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fn, nil, 0666); err != nil {
+			log.Fatal(err)
+		}
+		mtime := now.Add(-time.Duration(i+1) * time.Minute)
+		if name == "trace.out" {
+			mtime = now.Add(-48 * time.Hour)
+		}
+		if err := os.Chtimes(fn, mtime, mtime); err != nil {
+			log.Fatal(err)
+		}
+	}
+	profile.Start(profile.MemProfile, profile.ProfilePath(dir), profile.MaxFiles(3), profile.MaxAge(24*time.Hour), profile.Quiet).Stop()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var names []string
+	for _, fi := range files {
+		names = append(names, fi.Name())
+	}
+	if got, want := strings.Join(names, " "), "heap-1.pprof heap-2.pprof mem.pprof notes.txt"; got != want {
+		log.Fatalf("wanted %s kept, got %s", want, got)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			NoErr,
+		},
+	}, {
+		name: "filter labels with memory profile",
+		code: `
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"runtime/pprof"
+	"sync"
+
+	pprofile "github.com/google/pprof/profile"
+	"github.com/pkg/profile"
+)
+
+var sink [][]byte
+
+func main() {
+	dir := "` + root + `/filter-labels-mem"
+	p := profile.Start(profile.GoroutineProfile, profile.Also(profile.MemProfile), profile.FilterLabels("tenant", "^a$"), profile.ProfilePath(dir))
+	for i := 0; i < 1000; i++ {
+		sink = append(sink, make([]byte, 16<<10))
+	}
+	var wg sync.WaitGroup
+	block := make(chan struct{})
+	for _, tenant := range []string{"a", "b"} {
+		wg.Add(1)
+		go pprof.Do(context.Background(), pprof.Labels("tenant", tenant), func(context.Context) {
+			wg.Done()
+			<-block
+		})
+	}
+	wg.Wait()
+	p.Stop()
+	f, err := os.Open(dir + "/mem.pprof")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	prof, err := pprofile.Parse(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(prof.Sample) == 0 {
+		log.Fatal("memory profile emptied by label filter")
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: goroutine profiling enabled",
+				"profile: memory profiling enabled",
+				"profile: memory profiling disabled",
+				"profile: goroutine profiling disabled",
+				"goroutine.pprof by labels, kept 1 of"),
+			NoErr,
+		},
+	}, {
+		name: "isolated sessions",
+		code: `
+package main
+
+import (
+	"bytes"
+	"log"
+	"runtime/pprof"
+	"strings"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	p1 := profile.Start(profile.Isolated, profile.Labels("request", "1"), profile.ProfilePath("` + root + `/isolated/1"))
+	p2 := profile.Start(profile.Isolated, profile.GoroutineProfile, profile.ProfilePath("` + root + `/isolated/2"))
+	p3 := profile.Start(profile.Isolated, profile.ProfilePath("` + root + `/isolated/3"))
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 1)
+	if !strings.Contains(buf.String(), ` + "`" + `"request":"1"` + "`" + `) {
+		log.Fatalf("request label missing:\n%s", &buf)
+	}
+	p3.Stop()
+	p2.Stop()
+	p1.Stop()
+	defer profile.Start().Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: cpu profiling enabled",
+				"profile: goroutine profiling enabled",
+				"profile: cpu profiling enabled",
+				"profile: could not start cpu profile: cpu profiling already in use",
+				"profile: goroutine profiling disabled",
+				"profile: cpu profiling disabled",
+				"profile: cpu profiling enabled",
+				"profile: cpu profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "comment",
+		code: `
+package main
+
+import (
+	"io/ioutil"
+	"log"
+
+	"github.com/pkg/profile"
+	pprofile "github.com/google/pprof/profile"
+)
+
+func main() {
+	profile.Start(profile.MemProfile, profile.Comment("captured during incident-1234"), profile.ProfilePath("` + root + `/comment")).Stop()
+	data, err := ioutil.ReadFile("` + root + `/comment/mem.pprof")
+	if err != nil {
+		log.Fatal(err)
+	}
+	prof, err := pprofile.ParseData(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(prof.Comments) != 1 || prof.Comments[0] != "captured during incident-1234" {
+		log.Fatalf("unexpected comments: %q", prof.Comments)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: memory profiling enabled",
+				"profile: memory profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "affinity note",
+		code: `
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/profile"
+	pprofile "github.com/google/pprof/profile"
+)
+
+func main() {
+	profile.Start(profile.MemProfile, profile.AffinityNote, profile.Comment("pinned"), profile.ProfilePath("` + root + `/affinity")).Stop()
+	data, err := ioutil.ReadFile("` + root + `/affinity/mem.pprof")
+	if err != nil {
+		log.Fatal(err)
+	}
+	prof, err := pprofile.ParseData(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	want := 1
+	if runtime.GOOS == "linux" {
+		want = 2
+	}
+	if len(prof.Comments) != want || prof.Comments[0] != "pinned" {
+		log.Fatalf("unexpected comments: %q", prof.Comments)
+	}
+	if want == 2 && !strings.HasPrefix(prof.Comments[1], "cpu affinity: ") {
+		log.Fatalf("unexpected affinity comment: %q", prof.Comments[1])
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: memory profiling enabled",
+				"profile: memory profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "meta",
+		code: `
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/pkg/profile"
+	pprofile "github.com/google/pprof/profile"
+)
+
+func main() {
+	dir := "` + root + `/meta"
+	profile.Start(profile.MemProfile,
+		profile.Meta(map[string]string{"dc": "ams1", "experiment": "E42"}),
+		profile.Meta(map[string]string{"customer": "acme"}),
+		profile.ProfilePath(dir)).Stop()
+	data, err := ioutil.ReadFile(dir + "/meta.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	var meta map[string]string
+	if err := json.Unmarshal(data, &meta); err != nil {
+		log.Fatal(err)
+	}
+	if len(meta) != 3 || meta["customer"] != "acme" {
+		log.Fatalf("unexpected meta.json: %s", data)
+	}
+	data, err = ioutil.ReadFile(dir + "/mem.pprof")
+	if err != nil {
+		log.Fatal(err)
+	}
+	prof, err := pprofile.ParseData(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if got := strings.Join(prof.Comments, " "); got != "customer=acme dc=ams1 experiment=E42" {
+		log.Fatalf("unexpected comments: %q", prof.Comments)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: metadata written to "+filepath.Join(root, "meta", "meta.json"),
+				"profile: memory profiling enabled",
+				"profile: memory profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "gc before snapshot",
+		code: `
+package main
+
+import (
+	"log"
+	"runtime"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	profile.Start(profile.MemProfile, profile.GCBeforeSnapshot).Stop()
+	runtime.ReadMemStats(&after)
+	if after.NumForcedGC == before.NumForcedGC {
+		log.Fatal("no garbage collection before snapshot")
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: memory profiling enabled",
+				"profile: memory profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "min goroutines",
+		code: `
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	p := profile.Start(profile.MinGoroutines(10, 0))
+	done := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		go func() { <-done }()
+	}
+	time.Sleep(100 * time.Millisecond)
+	p.Stop()
+	close(done)
+
+	p = profile.Start(profile.MinGoroutines(1000, 20*time.Millisecond))
+	time.Sleep(100 * time.Millisecond)
+	p.Stop()
+
+	profile.Start(profile.MinGoroutines(1000, 0)).Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: waiting for 10 goroutines before profiling",
+				"profile: cpu profiling enabled",
+				"profile: cpu profiling disabled",
+				"profile: waiting for 1000 goroutines before profiling",
+				"profile: 1000 goroutines not reached within 20ms, profiling with",
+				"profile: cpu profiling enabled",
+				"profile: cpu profiling disabled",
+				"profile: waiting for 1000 goroutines before profiling"),
+			NoErr,
+		},
+	}, {
+		name: "start after",
+		code: `
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	var requests int64
+	p := profile.Start(profile.MemProfile, profile.StartAfter(&requests, 100))
+	for i := 0; i < 100; i++ {
+		atomic.AddInt64(&requests, 1)
+	}
+	time.Sleep(100 * time.Millisecond)
+	p.Stop()
+
+	profile.Start(profile.MemProfile, profile.StartAfter(&requests, 1000)).Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: waiting for counter to reach 100 before profiling",
+				"profile: memory profiling enabled",
+				"profile: memory profiling disabled",
+				"profile: waiting for counter to reach 1000 before profiling"),
+			NoErr,
+		},
+	}, {
+		name: "trace log",
+		code: `
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	profile.Start(profile.TraceProfile, profile.TraceLog("profile", "incident-1234"), profile.ProfilePath("` + root + `/tracelog")).Stop()
+	data, err := ioutil.ReadFile("` + root + `/tracelog/trace.out")
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, msg := range []string{"incident-1234: start", "incident-1234: stop"} {
+		if !bytes.Contains(data, []byte(msg)) {
+			log.Fatalf("%q missing from trace", msg)
+		}
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: trace enabled",
+				"profile: trace disabled"),
+			NoErr,
+		},
+	}, {
+		name: "trace marks",
+		code: `
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/trace-marks"
+	p := profile.Start(profile.TraceProfile, profile.Also(profile.BlockProfile), profile.Quiet, profile.ProfilePath(dir))
+	p.Flush()
+	p.Stop()
+	// the trace is rotated by Flush before the block profile.
+	data, err := ioutil.ReadFile(dir + "/trace.1.out")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if n := bytes.Count(data, []byte("block profile written")); n != 2 {
+		log.Fatalf("want 2 block profiles marked in trace, got %d", n)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			NoErr,
+		},
+	}, {
+		name: "ring buffer",
+		code: `
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	p := profile.Start(profile.GoroutineProfile, profile.RingBuffer(2), profile.ProfilePath("` + root + `/ring"))
+	for i := 0; i < 3; i++ {
+		p.Flush()
+	}
+	p.Stop()
+	for _, fn := range []string{"goroutine.pprof", "goroutine.1.pprof", "goroutine.2.pprof"} {
+		if _, err := os.Stat("` + root + `/ring/" + fn); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if _, err := os.Stat("` + root + `/ring/goroutine.3.pprof"); err == nil {
+		log.Fatal("goroutine.3.pprof should not exist")
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: goroutine profiling enabled",
+				"profile: goroutine profile snapshot kept in memory, 1 of 2",
+				"profile: goroutine profile snapshot kept in memory, 2 of 2",
+				"profile: goroutine profile snapshot kept in memory, 2 of 2",
+				"profile: goroutine profiling disabled",
+				"profile: goroutine profile flushed",
+				"profile: goroutine profile flushed"),
+			NoErr,
+		},
+	}, {
+		name: "capture and stop",
+		code: `
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	defer func() {
+		if r := recover(); r == nil {
+			log.Fatal("no panic")
+		}
+		for _, fn := range []string{"crash-goroutine.pprof", "crash-heap.pprof"} {
+			if _, err := os.Stat("` + root + `/crash/" + fn); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}()
+	p := profile.Start(profile.ProfilePath("` + root + `/crash"))
+	defer func() {
+		if r := recover(); r != nil {
+			p.CaptureAndStop()
+			panic(r)
+		}
+	}()
+	panic("boom")
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: cpu profiling enabled",
+				"profile: goroutine profile captured",
+				"profile: heap profile captured",
+				"profile: cpu profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "file",
+		code: `
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	f, err := os.Create("` + root + `/file.pprof")
+	if err != nil {
+		log.Fatal(err)
+	}
+	profile.Start(profile.MemProfile, profile.File(f)).Stop()
+	fi, err := f.Stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if fi.Size() == 0 {
+		log.Fatal("nothing written to file")
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: memory profiling enabled (rate 4096), "+filepath.Join(root, "file.pprof"),
+				"profile: memory profiling disabled, "+filepath.Join(root, "file.pprof")),
+			NoErr,
+		},
+	}, {
+		name: "web ui without go",
+		code: `
+package main
+
+import (
+	"os"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	os.Setenv("PATH", "")
+	defer profile.Start(profile.WebUI).Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: cpu profiling enabled",
+				"profile: cpu profiling disabled",
+				"profile: go command not found, not opening web ui"),
+			NoErr,
+		},
+	}, {
+		name: "pmu profile unknown event",
+		code: `
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/pmu-unknown"
+	profile.Start(profile.PMUProfile("bogus"), profile.ProfilePath(dir)).Stop()
+	if _, err := os.Stat(filepath.Join(dir, "pmu.pprof")); !os.IsNotExist(err) {
+		log.Fatalf("pmu.pprof left behind: %v", err)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: could not start pmu profile:"),
+			NoErr,
+		},
+	}, {
+		name: "write invocation",
+		code: `
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	os.Setenv("PROFILE_TEST_KEEP", "kept")
+	os.Setenv("PROFILE_TEST_SECRET", "hunter2")
+	profile.Start(profile.WriteInvocation("PROFILE_TEST_K*"), profile.ProfilePath("` + root + `/invocation")).Stop()
+	data, err := ioutil.ReadFile("` + root + `/invocation/invocation.txt")
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := string(data)
+	if !strings.Contains(s, "PROFILE_TEST_KEEP=kept") || strings.Contains(s, "hunter2") {
+		log.Fatalf("unexpected invocation:\n%s", s)
+	}
+	if !strings.Contains(s, os.Args[0]) {
+		log.Fatalf("%s missing from invocation:\n%s", os.Args[0], s)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: invocation written to",
+				"profile: cpu profiling enabled",
+				"profile: cpu profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "transform",
+		code: `
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+
+	"github.com/pkg/profile"
+	pprofile "github.com/google/pprof/profile"
+)
+
+func redact(data []byte) ([]byte, error) {
+	prof, err := pprofile.ParseData(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, fn := range prof.Function {
+		fn.Filename = "redacted"
+	}
+	var buf bytes.Buffer
+	err = prof.Write(&buf)
+	return buf.Bytes(), err
+}
+
+func main() {
+	profile.Start(profile.GoroutineProfile, profile.Transform(redact), profile.ProfilePath("` + root + `/transform")).Stop()
+	data, err := ioutil.ReadFile("` + root + `/transform/goroutine.pprof")
+	if err != nil {
+		log.Fatal(err)
+	}
+	prof, err := pprofile.ParseData(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, fn := range prof.Function {
+		if fn.Filename != "redacted" {
+			log.Fatalf("%s not redacted", fn.Filename)
+		}
+	}
+
+	fail := func([]byte) ([]byte, error) { return nil, errors.New("refused") }
+	profile.Start(profile.GoroutineProfile, profile.Transform(fail), profile.ProfilePath("` + root + `/transform")).Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: goroutine profiling enabled",
+				"profile: goroutine profiling disabled",
+				"profile: goroutine profiling enabled",
+				"profile: could not write goroutine profile",
+				"profile: goroutine profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "verify",
+		code: `
+package main
+
+import "github.com/pkg/profile"
+
+func truncate(data []byte) ([]byte, error) { return data[:len(data)/2], nil }
+
+func main() {
+	dir := profile.ProfilePath("` + root + `/verify")
+	profile.Start(profile.TraceProfile, profile.Also(profile.GoroutineProfile), profile.Verify, dir).Stop()
+	profile.Start(profile.GoroutineProfile, profile.Transform(truncate), profile.Verify, dir).Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: trace enabled",
+				"profile: goroutine profiling enabled",
+				"profile: goroutine profiling disabled",
+				"profile: trace disabled",
+				"profile: verified",
+				"profile: verified",
+				"profile: goroutine profiling enabled",
+				"profile: goroutine profiling disabled",
+				"profile: "+filepath.Join(root, "verify", "goroutine.pprof")+" is not a valid profile"),
+			NoErr,
+		},
+	}, {
+		name: "mutex and block profile rates",
+		code: `
+package main
+
+import (
+	"log"
+	"runtime"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	runtime.SetMutexProfileFraction(3)
+	p := profile.Start(profile.MutexProfileFraction(5), profile.Also(profile.BlockProfileRate(100)))
+	if rate := runtime.SetMutexProfileFraction(-1); rate != 5 {
+		log.Fatalf("mutex profile fraction during profiling: want 5, got %d", rate)
+	}
+	p.Stop()
+	if rate := runtime.SetMutexProfileFraction(-1); rate != 3 {
+		log.Fatalf("mutex profile fraction after profiling: want 3, got %d", rate)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: mutex profiling enabled (rate 5)",
+				"profile: block profiling enabled (rate 100)",
+				"profile: block profiling disabled",
+				"profile: mutex profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "on start",
+		code: `
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/onstart"
+	var got string
+	p := profile.Start(profile.MemProfile, profile.ProfilePath(dir), profile.OnStart(func(path string) {
+		if _, err := os.Stat(path); err != nil {
+			log.Fatal(err)
+		}
+		got = path
+		log.Print("started ", path)
+	}))
+	p.Stop()
+	if got != dir {
+		log.Fatalf("OnStart: want %s, got %s", dir, got)
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("started "+filepath.Join(root, "onstart"),
+				"profile: memory profiling enabled",
+				"profile: memory profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "flight recorder",
+		code: `
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	p := profile.Start(profile.FlightRecorder(time.Second), profile.ProfilePath("` + root + `/flight"))
+	time.Sleep(10 * time.Millisecond)
+	fn, err := p.Snapshot()
+	if err != nil {
+		log.Fatal(err)
+	}
+	p.Stop()
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("go 1.")) {
+		log.Fatalf("%s is not an execution trace", fn)
+	}
+	if _, err := p.Snapshot(); err == nil {
+		log.Fatal("Snapshot after Stop: want error")
+	}
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: flight recorder enabled",
+				"profile: flight recorder snapshot written, "+filepath.Join(root, "flight", "flight.1.trace"),
+				"profile: flight recorder disabled"),
+			NoErr,
+		},
+	}, {
+		name: "continuous",
+		code: `
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/profile"
+)
+
+func main() {
+	dir := "` + root + `/continuous"
+	p := profile.Start(profile.Continuous(20*time.Millisecond, 2), profile.ProfilePath(dir), profile.Verbosity(profile.LevelWarn))
+	time.Sleep(200 * time.Millisecond)
+	p.Stop()
+	files := make(map[string]bool)
+	for _, fn := range p.Files() {
+		files[fn] = true
+	}
+	for _, name := range []string{"heap", "goroutine"} {
+		matches, err := filepath.Glob(filepath.Join(dir, name+"-*.pprof"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(matches) != 2 {
+			log.Fatalf("wanted 2 %s profiles, got %v", name, matches)
+		}
+		for _, fn := range matches {
+			if !files[fn] {
+				log.Fatalf("%s not listed by Files: %q", fn, p.Files())
+			}
+		}
+	}
+	if len(files) != 5 {
+		log.Fatalf("wanted the cpu profile and 4 snapshots listed by Files, got %q", p.Files())
+	}
+}
+`,
+		checks: []checkFn{NoStdout, NoStderr, NoErr},
+	}, {
+		name: "labels from context",
+		code: `
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"runtime/pprof"
+	"strings"
+
+	"github.com/pkg/profile"
+)
+
+type spanKey struct{}
+
+func main() {
+	ctx := pprof.WithLabels(context.Background(), pprof.Labels("service", "api"))
+	ctx = context.WithValue(ctx, spanKey{}, "4bf92f3577b34da6")
+	extract := func(ctx context.Context, key string) (string, bool) {
+		id, ok := ctx.Value(spanKey{}).(string)
+		return id, ok && key == "span_id"
+	}
+	p := profile.Start(profile.LabelsFromContext(ctx, "span_id", "trace_id"), profile.LabelExtractor(extract))
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 1)
+	if !strings.Contains(buf.String(), ` + "`" + `labels: {"service":"api", "span_id":"4bf92f3577b34da6"}` + "`" + `) {
+		log.Fatalf("labels missing:\n%s", &buf)
+	}
+	p.Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: cpu profiling enabled",
+				"profile: cpu profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "when condition not met",
+		code: `
+package main
+
+import "github.com/pkg/profile"
+
+func main() {
+	never := func() bool { return false }
+	profile.Start(profile.When(never)).Stop()
+	profile.Start(profile.When(never)).Stop()
+	defer profile.Start().Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: condition not met, profiling disabled",
+				"profile: condition not met, profiling disabled",
+				"profile: cpu profiling enabled",
+				"profile: cpu profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "strict stop",
+		code: `
+package main
+
+import "github.com/pkg/profile"
+
+func main() {
+	p := profile.Start(profile.StrictStop)
+	p.Stop()
+	p.Stop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: cpu profiling enabled",
+				"profile: cpu profiling disabled",
+				"panic: profile: Stop called more than once"),
+			Err,
+		},
+	}, {
+		name: "strict stop when condition not met",
+		code: `
+package main
+
+import "github.com/pkg/profile"
+
+func main() {
+	never := func() bool { return false }
+	profile.Start(profile.StrictStop, profile.Quiet, profile.When(never)).Stop()
+}
+`,
+		checks: []checkFn{NoStdout, NoStderr, NoErr},
+	}, {
+		name: "strict stop capture after stop",
+		code: `
+package main
+
+import "github.com/pkg/profile"
+
+func main() {
+	p := profile.Start(profile.StrictStop)
+	p.Stop()
+	p.CaptureAndStop()
+}
+`,
+		checks: []checkFn{
+			NoStdout,
+			Stderr("profile: cpu profiling enabled",
+				"profile: cpu profiling disabled"),
+			NoErr,
+		},
+	}, {
+		name: "profile path",
+		code: `
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/pkg/profile"
+)
 
 func main() {
-	defer profile.Start(profile.BlockProfile).Stop()
-}	
+	// write cpu.pprof to a scratch directory, not the package's.
+	dir := "` + root + `/profile-path"
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		log.Fatal(err)
+	}
+	defer profile.Start(profile.ProfilePath(".")).Stop()
+}
 `,
 		checks: []checkFn{
 			NoStdout,
-			Stderr("profile: block profiling enabled"),
+			Stderr("profile: cpu profiling enabled, cpu.pprof"),
 			NoErr,
 		},
 	}, {
-		name: "mutex profile",
+		name: "temp root",
 		code: `
 package main
 
 import "github.com/pkg/profile"
 
 func main() {
-	defer profile.Start(profile.MutexProfile).Stop()
+	defer profile.Start(profile.TempRoot("` + root + `")).Stop()
 }
 `,
 		checks: []checkFn{
 			NoStdout,
-			Stderr("profile: mutex profiling enabled"),
+			Stderr("profile: cpu profiling enabled, " + filepath.Join(root, "profile")),
 			NoErr,
 		},
 	}, {
-		name: "clock profile",
+		name: "profile path from environment",
 		code: `
 package main
 
-import "github.com/pkg/profile"
+import (
+	"os"
+
+	"github.com/pkg/profile"
+)
 
 func main() {
-	defer profile.Start(profile.ClockProfile).Stop()
+	os.Setenv("PROFILE_PATH", "` + root + `/env")
+	defer profile.Start(profile.ProfilePath("` + root + `/code")).Stop()
 }
 `,
 		checks: []checkFn{
 			NoStdout,
-			Stderr("profile: clock profiling enabled"),
+			Stderr("profile: cpu profiling enabled, "+filepath.Join(root, "env", "cpu.pprof"),
+				"profile: cpu profiling disabled, "+filepath.Join(root, "env", "cpu.pprof")),
 			NoErr,
 		},
 	}, {
-		name: "profile path",
+		name: "profile path error",
 		code: `
 package main
 
 import "github.com/pkg/profile"
 
 func main() {
-	defer profile.Start(profile.ProfilePath(".")).Stop()
+		defer profile.Start(profile.ProfilePath("` + f.Name() + `")).Stop()
 }	
 `,
 		checks: []checkFn{
 			NoStdout,
-			Stderr("profile: cpu profiling enabled, cpu.pprof"),
-			NoErr,
+			Stderr("could not create initial output"),
+			Err,
 		},
 	}, {
-		name: "profile path error",
+		name: "insufficient free space",
 		code: `
 package main
 
 import "github.com/pkg/profile"
 
 func main() {
-		defer profile.Start(profile.ProfilePath("` + f.Name() + `")).Stop()
-}	
+	defer profile.Start(profile.MinFreeSpace(1 << 62)).Stop()
+}
 `,
 		checks: []checkFn{
 			NoStdout,
-			Stderr("could not create initial output"),
+			Stderr("profile: insufficient free space"),
 			Err,
 		},
 	}, {
@@ -221,6 +3717,425 @@ func main() {
 	}
 }
 
+var sanitizeTests = []struct {
+	input string
+	want  string
+}{{
+	input: "myservice",
+	want:  "myservice",
+}, {
+	input: "my service/v2",
+	want:  "my_service_v2",
+}, {
+	input: "..hidden",
+	want:  "hidden",
+}}
+
+func TestSanitize(t *testing.T) {
+	for _, tt := range sanitizeTests {
+		got := sanitize(tt.input)
+		if got != tt.want {
+			t.Errorf("sanitize(%q), want %q, got %q", tt.input, tt.want, got)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		err      error
+		attempts int
+		want     int
+	}{
+		{nil, 3, 1},
+		{&os.PathError{Op: "mkdir", Path: "x", Err: syscall.ENOSPC}, 3, 3},
+		{&os.PathError{Op: "mkdir", Path: "x", Err: syscall.EAGAIN}, 1, 1},
+		{&os.PathError{Op: "mkdir", Path: "x", Err: syscall.EACCES}, 3, 1},
+	}
+	for _, tt := range tests {
+		calls := 0
+		err := retry(tt.attempts, time.Microsecond, t.Logf, func() error {
+			calls++
+			return tt.err
+		})
+		if err != tt.err {
+			t.Errorf("retry(%v): wanted error %v, got %v", tt.err, tt.err, err)
+		}
+		if calls != tt.want {
+			t.Errorf("retry(%v): wanted %d calls, got %d", tt.err, tt.want, calls)
+		}
+	}
+}
+
+// memFS is an in memory FileSystem.
+type memFS struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	dirs  []string
+}
+
+type memFile struct {
+	bytes.Buffer
+	fs   *memFS
+	name string
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	f.fs.files[f.name] = f.Bytes()
+	return nil
+}
+
+func (fs *memFS) Create(name string) (io.WriteCloser, error) {
+	return &memFile{fs: fs, name: name}, nil
+}
+
+func (fs *memFS) Open(name string) (io.ReadCloser, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	data, ok := fs.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (fs *memFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	delete(fs.files, name)
+	return nil
+}
+
+func (fs *memFS) MkdirAll(path string, _ os.FileMode) error {
+	fs.dirs = append(fs.dirs, path)
+	return nil
+}
+
+func (fs *memFS) MkdirTemp(dir, pattern string) (string, error) {
+	path := filepath.Join(dir, pattern+"1")
+	fs.dirs = append(fs.dirs, path)
+	return path, nil
+}
+
+func TestFS(t *testing.T) {
+	fs := &memFS{files: make(map[string][]byte)}
+	Start(MemProfile, FS(fs), ProfilePath("profiles"), Comment("in memory"), Quiet).Stop()
+	if len(fs.dirs) != 1 || fs.dirs[0] != "profiles" {
+		t.Errorf("FS: wanted directory [profiles], got %v", fs.dirs)
+	}
+	if len(fs.files) != 1 {
+		t.Fatalf("FS: wanted 1 file, got %d", len(fs.files))
+	}
+	data, ok := fs.files[filepath.Join("profiles", "mem.pprof")]
+	if !ok {
+		t.Fatalf("FS: mem.pprof not written")
+	}
+	prof, err := pprofile.ParseData(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prof.Comments) != 1 || prof.Comments[0] != "in memory" {
+		t.Errorf("FS: wanted comments [in memory], got %q", prof.Comments)
+	}
+}
+
+// flakyFile makes short writes of at most max bytes, then fails
+// with err after failAfter bytes if err is not nil.
+type flakyFile struct {
+	*memFile
+	max       int
+	failAfter int
+	err       error
+}
+
+func (f *flakyFile) Write(buf []byte) (int, error) {
+	if f.err != nil && f.Len() >= f.failAfter {
+		return 0, f.err
+	}
+	if len(buf) > f.max {
+		buf = buf[:f.max]
+	}
+	return f.memFile.Write(buf)
+}
+
+type flakyFS struct {
+	*memFS
+	err error
+}
+
+func (fs *flakyFS) Create(name string) (io.WriteCloser, error) {
+	return &flakyFile{memFile: &memFile{fs: fs.memFS, name: name}, max: 4, failAfter: 4, err: fs.err}, nil
+}
+
+func TestStopErr(t *testing.T) {
+	fs := &memFS{files: make(map[string][]byte)}
+	p, err := StartErr(FS(fs), MemProfile, ProfilePath("/profiles"), Quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := p.StopErr()
+	if err != nil || len(files) != 1 || files[0] != filepath.Join("/profiles", "mem.pprof") {
+		t.Errorf("StopErr: wanted mem.pprof written, got %q: %v", files, err)
+	}
+
+	full := errors.New("disk full")
+	p, err = StartErr(FS(&flakyFS{memFS: fs, err: full}), MemProfile, ProfilePath("/profiles"), Quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err = p.StopErr()
+	if err == nil || !strings.Contains(err.Error(), full.Error()) || len(files) != 0 {
+		t.Errorf("StopErr: wanted %v and no files, got %q: %v", full, files, err)
+	}
+}
+
+func TestAwaitErr(t *testing.T) {
+	fs := &memFS{files: make(map[string][]byte)}
+	p, err := StartErr(FS(failFS{fs, "mem.pprof"}), MemProfile, MinGoroutines(1, 0), ProfilePath("/profiles"), Quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * goroutinePoll)
+	files, err := p.StopErr()
+	if err == nil || !strings.Contains(err.Error(), "could not create memory profile") || len(files) != 0 {
+		t.Errorf("StopErr: wanted could not create memory profile and no files, got %q: %v", files, err)
+	}
+}
+
+func TestBeginErr(t *testing.T) {
+	fs := &memFS{files: make(map[string][]byte)}
+	p, err := StartErr(Lazy, FS(failFS{fs, "mem.pprof"}), MemProfile, ProfilePath("/profiles"), Quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.BeginErr(); err == nil || !strings.Contains(err.Error(), "could not create memory profile") {
+		t.Errorf("BeginErr: wanted could not create memory profile, got %v", err)
+	}
+	p.Stop()
+	p, err = StartErr(FS(fs), MemProfile, ProfilePath("/profiles"), Quiet)
+	if err != nil {
+		t.Fatalf("StartErr after a failed BeginErr: %v", err)
+	}
+	p.Stop()
+}
+
+func TestCaptureAndStopErr(t *testing.T) {
+	var buf bytes.Buffer
+	fs := &flakyFS{memFS: &memFS{files: make(map[string][]byte)}, err: errors.New("disk full")}
+	p, err := StartErr(FS(fs), GoroutineProfile, ProfilePath("/profiles"), Logger(log.New(&buf, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.CaptureAndStop()
+	out := buf.String()
+	if strings.Contains(out, "captured") {
+		t.Errorf("CaptureAndStop: logged a capture which failed:\n%s", out)
+	}
+	if !strings.Contains(out, "could not write goroutine profile") || !strings.Contains(out, "could not write heap profile") {
+		t.Errorf("CaptureAndStop: wanted the failures logged, got:\n%s", out)
+	}
+}
+
+func TestPathFiles(t *testing.T) {
+	fs := &memFS{files: make(map[string][]byte)}
+	p, err := StartErr(FS(fs), MemProfile, Also(BlockProfile), TempRoot("/tmp"), Quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join("/tmp", "profile1")
+	if got := p.Path(); got != dir {
+		t.Errorf("Path: wanted %q, got %q", dir, got)
+	}
+	want := []string{filepath.Join(dir, "mem.pprof"), filepath.Join(dir, "block.pprof")}
+	if got := p.Files(); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Files: wanted %q, got %q", want, got)
+	}
+	p.Stop()
+}
+
+func TestOnStop(t *testing.T) {
+	fs := &memFS{files: make(map[string][]byte)}
+	var got []string
+	p, err := StartErr(FS(fs), MemProfile, ProfilePath("/profiles"), Quiet, OnStop(func(files []string) {
+		got = files
+		if _, ok := fs.files[files[0]]; !ok {
+			t.Errorf("OnStop: %s not yet written", files[0])
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Stop()
+	if want := filepath.Join("/profiles", "mem.pprof"); len(got) != 1 || got[0] != want {
+		t.Errorf("OnStop: wanted %q, got %q", want, got)
+	}
+}
+
+func TestLifecycleHooks(t *testing.T) {
+	fs := &memFS{files: make(map[string][]byte)}
+	var calls []string
+	var start time.Time
+	var results Results
+	hooks := []func(*Profile){
+		BeforeStart(func(t time.Time) { calls, start = append(calls, "before start"), t }),
+		OnStart(func(string) { calls = append(calls, "on start") }),
+		OnStop(func([]string) { calls = append(calls, "on stop") }),
+		AfterStop(func(r Results) { calls, results = append(calls, "after stop"), r }),
+	}
+	p, err := StartErr(append(hooks, FS(fs), MemProfile, ProfilePath("/profiles"), Quiet)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Stop()
+	if got, want := strings.Join(calls, ", "), "before start, on start, on stop, after stop"; got != want {
+		t.Errorf("hooks: wanted %s, got %s", want, got)
+	}
+	if results.Start.Before(start) || !results.End.After(results.Start) {
+		t.Errorf("AfterStop: wanted session after %v, got %v to %v", start, results.Start, results.End)
+	}
+
+	calls = nil
+	p, err = StartErr(append(hooks, FS(fs), When(func() bool { return false }), Quiet)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Stop()
+	if len(calls) != 0 {
+		t.Errorf("hooks: wanted none called when not profiling, got %q", calls)
+	}
+}
+
+func TestStartWithContext(t *testing.T) {
+	fs := &memFS{files: make(map[string][]byte)}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan []string, 1)
+	p := StartWithContext(ctx, FS(fs), MemProfile, ProfilePath("/profiles"), Quiet, OnStop(func(files []string) {
+		stopped <- files
+	}))
+	cancel()
+	select {
+	case files := <-stopped:
+		if len(files) != 1 {
+			t.Errorf("StartWithContext: wanted mem.pprof written, got %q", files)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("StartWithContext: session not stopped when context canceled")
+	}
+	p.Stop()
+}
+
+func TestOutputFile(t *testing.T) {
+	fs := &flakyFS{memFS: &memFS{files: make(map[string][]byte)}}
+	p := &Profile{fs: fs}
+	f, err := p.create(memMode, "mem.pprof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := f.Write([]byte("abcdef")); n != 6 || err != nil {
+		t.Errorf("Write: wanted 6 bytes written, got %d: %v", n, err)
+	}
+	if err := p.close(f); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fs.files["mem.pprof"]); got != "abcdef" || len(p.files) != 1 {
+		t.Errorf("close: wanted mem.pprof to hold abcdef, got %q, %d files", got, len(p.files))
+	}
+
+	fs.err = errors.New("disk gone")
+	f, err = p.create(memMode, "block.pprof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("abcdef")); err != fs.err {
+		t.Errorf("Write: wanted %v, got %v", fs.err, err)
+	}
+	if err := p.close(f); err != fs.err {
+		t.Errorf("close: wanted %v, got %v", fs.err, err)
+	}
+	if _, ok := fs.files["block.pprof"]; ok || len(p.files) != 1 {
+		t.Errorf("close: wanted block.pprof removed, got %d files", len(p.files))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	notDir := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(notDir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	runs := filepath.Join(dir, "runs")
+	if err := os.Mkdir(runs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(runs, "cpu.pprof"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		options []func(*Profile)
+		want    string
+	}{
+		{[]func(*Profile){ProfilePath(filepath.Join(dir, "out"))}, ""},
+		{[]func(*Profile){TempRoot(dir), MemProfile}, ""},
+		{[]func(*Profile){ProfilePath(filepath.Join(notDir, "out"))}, "could not create output directory"},
+		{[]func(*Profile){ProfilePath(dir), CPUProfileRate(0)}, "invalid cpu profile rate 0 Hz"},
+		{[]func(*Profile){ProfilePath(dir), Labels("key")}, "Labels requires key value pairs"},
+		{[]func(*Profile){ProfilePath(dir), FilterLabels("key", "(")}, "invalid label filter"},
+		{[]func(*Profile){ProfilePath(dir), MinFreeSpace(1 << 62)}, "insufficient free space"},
+		{[]func(*Profile){ProfilePath(runs), DirPolicy(Fail)}, "already holds profiles"},
+		{[]func(*Profile){ProfilePath(runs), DirPolicy(Number)}, ""},
+		{[]func(*Profile){ProfilePath(dir), Compressor(".zst", nil)}, "Compressor requires a writer"},
+		{[]func(*Profile){ProfilePath(dir), FilenameTemplate("{{.Name")}, "invalid filename template"},
+		{[]func(*Profile){ProfilePath(dir), ProfileName(CPUProfile, "run/cpu.pprof")}, "invalid profile name"},
+		{[]func(*Profile){ProfilePath(dir), Duration(0)}, "invalid duration 0s"},
+		{[]func(*Profile){ProfilePath(dir), Delay(-time.Second)}, "invalid delay -1s"},
+		{[]func(*Profile){ProfilePath(dir), FilenameTemplate("{{.Nope}}")}, "invalid filename template"},
+		{[]func(*Profile){ProfilePath(dir), FilenameTemplate("{{.Name}}-{{.Host}}{{.Ext}}")}, ""},
+	}
+	for _, tt := range tests {
+		err := Validate(append(tt.options, DirAttempts(1))...)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("Validate: wanted no error, got %v", err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("Validate: wanted error containing %q, got %v", tt.want, err)
+		}
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != "file" && e.Name() != "out" && e.Name() != "runs" {
+			t.Errorf("Validate: left %s behind", e.Name())
+		}
+	}
+	if entries, _ := ioutil.ReadDir(filepath.Join(dir, "out")); len(entries) != 0 {
+		t.Errorf("Validate: left probe file behind, got %d files", len(entries))
+	}
+}
+
+func TestLatestList(t *testing.T) {
+	fs := &memFS{files: make(map[string][]byte)}
+	Start(MemProfile, FS(fs), ProfilePath("profiles"), LatestSymlink, Quiet).Stop()
+	want := filepath.Join("profiles", "mem.pprof") + "\n"
+	if got := string(fs.files[filepath.Join("profiles", "latest.txt")]); got != want {
+		t.Errorf("LatestSymlink: wanted latest.txt to hold %q, got %q", want, got)
+	}
+}
+
+func TestUnderTest(t *testing.T) {
+	if !underTest() {
+		t.Errorf("underTest: wanted true, got false")
+	}
+}
+
 // NoStdout checks that stdout was blank.
 func NoStdout(t *testing.T, stdout, _ []byte, _ error) {
 	if len := len(stdout); len > 0 {
@@ -306,6 +4221,129 @@ profile: no
 	want:  false,
 }}
 
+func TestFilenameTemplate(t *testing.T) {
+	p := &Profile{path: "out", nameTime: time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)}
+	FilenameTemplate("{{.Name}}-{{.Time}}-{{.PID}}{{.Ext}}")(p)
+	if p.invalid != nil {
+		t.Fatal(p.invalid)
+	}
+	want := filepath.Join("out", fmt.Sprintf("cpu-20060102T150405Z-%d.pprof", os.Getpid()))
+	if got := p.filename("cpu.pprof"); got != want {
+		t.Errorf("filename: want %q, got %q", want, got)
+	}
+	CorrelationID("run")(p)
+	want = filepath.Join("out", fmt.Sprintf("run-trace-20060102T150405Z-%d.out", os.Getpid()))
+	if got := p.filename("trace.out"); got != want {
+		t.Errorf("filename: want %q, got %q", want, got)
+	}
+}
+
+func TestThreadcreateProfile(t *testing.T) {
+	var p Profile
+	ThreadcreateProfile(&p)
+	if p.mode != threadCreateMode || p.lookup(p.mode) != "threadcreate" {
+		t.Errorf("ThreadcreateProfile: wanted the threadcreate profile, got mode %d", p.mode)
+	}
+}
+
+func TestHostPID(t *testing.T) {
+	p := &Profile{path: "out"}
+	HostPID(p)
+	Reason("panic")(p)
+	want := filepath.Join("out", fmt.Sprintf("cpu-%s-%d.panic.pprof", hostname(), os.Getpid()))
+	if got := p.filename("cpu.pprof"); got != want {
+		t.Errorf("filename: want %q, got %q", want, got)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	fs := &memFS{files: make(map[string][]byte)}
+	p, err := StartErr(FS(fs), GoroutineProfile, Also(TraceProfile), Compress, ProfilePath("/profiles"), Quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := p.StopErr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join("/profiles", "goroutine.pprof"), filepath.Join("/profiles", "trace.out.gz")}
+	if strings.Join(files, " ") != strings.Join(want, " ") {
+		t.Errorf("StopErr: wanted %q, got %q", want, files)
+	}
+	// the pprof profile keeps its name, gzip encoded only once.
+	data := fs.files[want[0]]
+	plain, err := gunzip(data)
+	if err != nil {
+		t.Fatalf("goroutine.pprof: %v", err)
+	}
+	if len(plain) >= 2 && plain[0] == 0x1f && plain[1] == 0x8b {
+		t.Errorf("goroutine.pprof: compressed twice")
+	}
+	if _, err := pprofile.ParseData(data); err != nil {
+		t.Errorf("goroutine.pprof: %v", err)
+	}
+}
+
+func TestCompressOver(t *testing.T) {
+	data := bytes.Repeat([]byte("profile"), 100)
+	fs := &memFS{files: map[string][]byte{"over.pprof": data, "under.pprof": data}}
+	if got, err := compressOver(fs, "under.pprof", int64(len(data))); err != nil || got != "under.pprof" {
+		t.Errorf("compressOver(under.pprof): want %q, got %q, %v", "under.pprof", got, err)
+	}
+	if _, ok := fs.files["under.pprof.gz"]; ok {
+		t.Errorf("compressOver(under.pprof): compressed under the threshold")
+	}
+	got, err := compressOver(fs, "over.pprof", int64(len(data))-1)
+	if err != nil || got != "over.pprof.gz" {
+		t.Fatalf("compressOver(over.pprof): want %q, got %q, %v", "over.pprof.gz", got, err)
+	}
+	if _, ok := fs.files["over.pprof"]; ok {
+		t.Errorf("compressOver(over.pprof): original not removed")
+	}
+	plain, err := gunzip(fs.files["over.pprof.gz"])
+	if err != nil || !bytes.Equal(plain, data) {
+		t.Errorf("compressOver(over.pprof): want the original contents, got %d bytes, %v", len(plain), err)
+	}
+	if got, err := compressOver(fs, "over.pprof.gz", 0); err != nil || got != "over.pprof.gz" {
+		t.Errorf("compressOver(over.pprof.gz): want %q, got %q, %v", "over.pprof.gz", got, err)
+	}
+}
+
+func TestCompressErr(t *testing.T) {
+	var buf bytes.Buffer
+	fs := failFS{&memFS{files: make(map[string][]byte)}, "trace.out.gz"}
+	p, err := StartErr(FS(fs), TraceProfile, CompressOver(0), Verify, ProfilePath("/profiles"), Logger(log.New(&buf, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, _ := p.StopErr()
+	fn := filepath.Join("/profiles", "trace.out")
+	if len(files) != 1 || files[0] != fn {
+		t.Errorf("StopErr: wanted %s kept, got %q", fn, files)
+	}
+	if out := buf.String(); !strings.Contains(out, "profile: verified "+fn) {
+		t.Errorf("Stop: wanted %s verified after the compression failed, got:\n%s", fn, out)
+	}
+}
+
+func TestNextNumber(t *testing.T) {
+	fs := &memFS{files: map[string][]byte{
+		"cpu.1.pprof":    nil,
+		"trace.1.out.gz": nil,
+	}}
+	p := &Profile{fs: fs, dirPolicy: Number}
+	for _, tt := range []struct{ fn, want string }{
+		{"cpu.pprof", "cpu.2.pprof"},
+		{"cpu.pprof", "cpu.3.pprof"},
+		{"trace.out.gz", "trace.2.out.gz"},
+		{"mem.pprof", "mem.1.pprof"},
+	} {
+		if got := p.next(tt.fn); got != tt.want {
+			t.Errorf("next(%q): want %q, got %q", tt.fn, tt.want, got)
+		}
+	}
+}
+
 func TestValidateOutput(t *testing.T) {
 	for _, tt := range validateOutputTests {
 		r := strings.NewReader(tt.input)
@@ -344,3 +4382,75 @@ func runTest(t *testing.T, code string) ([]byte, []byte, error) {
 	err = cmd.Run()
 	return stdout.Bytes(), stderr.Bytes(), err
 }
+
+// failFS is a memFS in which the file named fail cannot be created.
+type failFS struct {
+	*memFS
+	fail string
+}
+
+func (fs failFS) Create(name string) (io.WriteCloser, error) {
+	if filepath.Base(name) == fs.fail {
+		return nil, &os.PathError{Op: "create", Path: name, Err: os.ErrPermission}
+	}
+	return fs.memFS.Create(name)
+}
+
+func TestStartErr(t *testing.T) {
+	fs := &memFS{files: make(map[string][]byte)}
+	rate := runtime.MemProfileRate
+	tests := []struct {
+		options []func(*Profile)
+		want    string
+	}{
+		{[]func(*Profile){CPUProfileRate(0)}, "invalid cpu profile rate 0 Hz"},
+		{[]func(*Profile){FS(failFS{fs, "mem.pprof"}), MemProfile}, "could not create memory profile"},
+		{[]func(*Profile){FS(failFS{fs, "block.pprof"}), MemProfile, Also(BlockProfile)}, "could not create block profile"},
+		{[]func(*Profile){FS(failFS{fs, "pmu.pprof"}), PMUProfile("cycles")}, "could not create pmu profile"},
+		{[]func(*Profile){FS(fs), MemProfile}, ""},
+	}
+	for _, tt := range tests {
+		p, err := StartErr(append(tt.options, ProfilePath("/profiles"), Quiet)...)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("StartErr: wanted no error, got %v", err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("StartErr: wanted error containing %q, got %v", tt.want, err)
+		}
+		if p != nil {
+			p.Stop()
+		}
+		if runtime.MemProfileRate != rate {
+			t.Errorf("StartErr: wanted memory profile rate %d restored, got %d", rate, runtime.MemProfileRate)
+		}
+	}
+	if _, ok := fs.files["/profiles/mem.pprof"]; !ok {
+		t.Errorf("StartErr: wanted mem.pprof written")
+	}
+}
+
+func TestSetDefaultMemProfileRate(t *testing.T) {
+	orig := defaultMemProfileRate()
+	defer SetDefaultMemProfileRate(orig)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			SetDefaultMemProfileRate(512)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		var p Profile
+		MemProfile(&p)
+		if p.memProfileRate != 512 && p.memProfileRate != orig {
+			t.Fatalf("MemProfile: unexpected rate %d", p.memProfileRate)
+		}
+	}
+	wg.Wait()
+	var p Profile
+	MemProfile(&p)
+	if p.memProfileRate != 512 {
+		t.Errorf("MemProfile: want rate 512, got %d", p.memProfileRate)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build go1.21
+// +build go1.21
+
+package profile
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Slog logs the start and stop of profiling to l as structured records,
+// in place of the informational log messages, for log pipelines which
+// index their attributes. Each record, "profile start" or "profile stop",
+// has the attributes mode and path, rate for memory profiles, and for
+// stop records the duration of profiling and the bytes written. Records
+// are logged at slog.LevelInfo, and Quiet suppresses them.
+func Slog(l *slog.Logger) func(*Profile) {
+	return func(p *Profile) {
+		p.logEvent = func(ev event) {
+			attrs := []slog.Attr{
+				slog.String("mode", ev.Mode),
+				slog.String("path", ev.Path),
+			}
+			if ev.Rate != 0 {
+				attrs = append(attrs, slog.Int("rate", ev.Rate))
+			}
+			if ev.Event == "stop" {
+				attrs = append(attrs, slog.Duration("duration", ev.Duration), slog.Int64("bytes", ev.Bytes))
+			}
+			l.LogAttrs(context.Background(), slog.LevelInfo, "profile "+ev.Event, attrs...)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+//go:build go1.21
+// +build go1.21
+
+package profile
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestSlog(t *testing.T) {
+	var buf bytes.Buffer
+	l := slog.New(slog.NewJSONHandler(&buf, nil))
+	fs := &memFS{files: make(map[string][]byte)}
+	Start(MemProfile, Slog(l), FS(fs), ProfilePath("/profiles")).Stop()
+
+	var records []map[string]interface{}
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var r map[string]interface{}
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Slog: wanted 2 records, got %v", records)
+	}
+	start, stop := records[0], records[1]
+	if start["msg"] != "profile start" || start["mode"] != "mem" || start["path"] != "/profiles/mem.pprof" || start["rate"] != float64(DefaultMemProfileRate) {
+		t.Errorf("Slog: unexpected start record %v", start)
+	}
+	if stop["msg"] != "profile stop" || stop["mode"] != "mem" {
+		t.Errorf("Slog: unexpected stop record %v", stop)
+	}
+	if n, _ := stop["bytes"].(float64); int(n) != len(fs.files["/profiles/mem.pprof"]) || n == 0 {
+		t.Errorf("Slog: wanted bytes %d, got %v", len(fs.files["/profiles/mem.pprof"]), stop["bytes"])
+	}
+	if _, ok := stop["duration"]; !ok {
+		t.Errorf("Slog: stop record has no duration: %v", stop)
+	}
+}
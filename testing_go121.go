@@ -0,0 +1,9 @@
+//go:build go1.21
+// +build go1.21
+
+package profile
+
+import "testing"
+
+// underTest reports whether the program is a test binary built by go test.
+func underTest() bool { return testing.Testing() }
@@ -0,0 +1,20 @@
+//go:build !go1.21
+// +build !go1.21
+
+package profile
+
+import (
+	"os"
+	"strings"
+)
+
+// underTest reports whether the program appears to be a test binary
+// built by go test, by looking for test flags on its command line.
+func underTest() bool {
+	for _, arg := range os.Args[1:] {
+		if strings.HasPrefix(arg, "-test.") || strings.HasPrefix(arg, "--test.") {
+			return true
+		}
+	}
+	return false
+}
@@ -1,8 +1,34 @@
 package profile_test
 
-import "github.com/pkg/profile"
+import (
+	"time"
+
+	"github.com/pkg/profile"
+)
 
 func ExampleTraceProfile() {
 	// use execution tracing, rather than the default cpu profiling.
 	defer profile.Start(profile.TraceProfile).Stop()
 }
+
+func ExampleAlso() {
+	// capture an execution trace and a cpu profile of the same run.
+	defer profile.Start(profile.TraceProfile, profile.Also(profile.CPUProfile)).Stop()
+}
+
+func ExampleTraceLog() {
+	// mark the start and end of tracing in go tool trace.
+	defer profile.Start(profile.TraceProfile, profile.TraceLog("profile", "load test")).Stop()
+}
+
+func ExampleFlightRecorder() {
+	// keep the last few seconds of the execution trace in memory,
+	// writing them out when something goes wrong.
+	p := profile.Start(profile.FlightRecorder(5 * time.Second))
+	defer p.Stop()
+
+	slow := func() bool { return false }
+	if slow() {
+		p.Snapshot()
+	}
+}